@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func (h *httpHandler) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if Options.AdminToken == "" {
+		// 挿入と同じポートなので、認証なしでは操作させない
+		h.forbidden(w, r, "admin token is not configured")
+		return
+	} else if !checkAdminToken(r) {
+		h.unauthorized(w, r, "unauthorized")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/admin/drain":
+		h.serveDrain(w, r, true)
+	case "/admin/undrain":
+		h.serveDrain(w, r, false)
+	case "/admin/readonly":
+		h.serveReadOnly(w, r, true)
+	case "/admin/readwrite":
+		h.serveReadOnly(w, r, false)
+	case "/admin/errors":
+		h.serveRecentErrors(w, r)
+	case "/admin/config":
+		h.serveConfig(w, r)
+	case "/admin/reload":
+		h.serveReload(w, r)
+	default:
+		h.notFound(w, r, "not found")
+	}
+}
+
+// checkAdminToken verifies the bearer token of an admin request.
+// Admin endpoints are disabled when -admin-token is not set.
+func checkAdminToken(r *http.Request) bool {
+	token := bearerToken(r)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(Options.AdminToken)) == 1
+}
+
+// serveDrain stops or resumes accepting inserts. Health endpoints are not
+// affected so that the instance stays in the pool while traffic is shifted.
+// Keep-alive is disabled while draining, so idle connections are closed and
+// the load balancer moves them to other instances.
+func (h *httpHandler) serveDrain(w http.ResponseWriter, r *http.Request, draining bool) {
+	if r.Method != "POST" {
+		h.methodNotAllowed(w, r, "method not allowed")
+		return
+	}
+	h.setDraining(draining)
+	if h.server != nil {
+		h.server.SetKeepAlivesEnabled(!draining)
+	}
+	logger.Noticef("draining %v", draining)
+	h.ok(w, []byte(fmt.Sprintf(`{"draining": %v}`, draining)))
+}
+
+// serveReadOnly turns the read-only mode for maintenance on or off.
+func (h *httpHandler) serveReadOnly(w http.ResponseWriter, r *http.Request, readonly bool) {
+	if r.Method != "POST" {
+		h.methodNotAllowed(w, r, "method not allowed")
+		return
+	}
+	h.setReadOnly(readonly)
+	logger.Noticef("readonly %v", readonly)
+	h.ok(w, []byte(fmt.Sprintf(`{"readonly": %v}`, readonly)))
+}
+
+// serveConfig returns the effective options. Secrets are excluded from
+// the JSON by their struct tags.
+func (h *httpHandler) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.methodNotAllowed(w, r, "method not allowed")
+		return
+	}
+	body, err := json.Marshal(&Options)
+	if err != nil {
+		h.internalError(w, r, err.Error())
+		return
+	}
+	h.ok(w, body)
+}
+
+// serveReload drops the cached state so that it is built again.
+func (h *httpHandler) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		h.methodNotAllowed(w, r, "method not allowed")
+		return
+	}
+	schemas.invalidate()
+	logger.Noticef("reloaded")
+	h.ok(w, []byte(`{"reloaded": true}`))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+var errArrayRoute = fmt.Errorf("routing is not supported for JSON array bodies")
+
+// -chunk-rowsが0のときにJSON配列をまとめて書き込む行数
+const defaultArrayChunkRows = 500
+
+// requestBody is the body of an insert request. A JSON array body is
+// decoded while it is read, other bodies are read at once.
+type requestBody struct {
+	data  []byte
+	array io.Reader
+
+	// -max-buffer-bytesと-max-queued-rowsに対して予約した分
+	reservedBytes int64
+	reservedRows  int64
+}
+
+// take moves the reservations of the body to the returned copy, for a
+// write that goes on after the handler returned and released the body.
+func (b *requestBody) take() *requestBody {
+	c := *b
+	b.reservedBytes, b.reservedRows = 0, 0
+	return &c
+}
+
+// buffer reads a JSON array body at once, for the writes that go on after
+// the response, when the request body can no longer be read.
+func (b *requestBody) buffer() (*requestBody, error) {
+	if b.array == nil {
+		return b, nil
+	}
+	data, err := ioutil.ReadAll(b.array)
+	if err != nil {
+		return nil, err
+	}
+	return &requestBody{data: data, array: bytes.NewReader(data)}, nil
+}
+
+// arrayReservation reserves -max-buffer-bytes and -max-queued-rows for the
+// elements of a JSON array body while they are held, since the size of the
+// array is not known before it is read. A nil reservation reserves nothing.
+type arrayReservation struct {
+	h *httpHandler
+
+	// 本文全体のバイト数を予約済みなら行数だけ予約する
+	rowsOnly bool
+
+	bytes int64
+	rows  int64
+}
+
+// reserve reserves an element of n bytes.
+func (a *arrayReservation) reserve(n int64) error {
+	if a == nil {
+		return nil
+	}
+	if a.rowsOnly {
+		n = 0
+	}
+	if !a.h.reserveBuffer(n) {
+		return errTooManyBufferedBytes
+	}
+	if !a.h.reserveRows(1) {
+		a.h.releaseBuffer(n)
+		return errTooManyQueuedRows
+	}
+	a.bytes += n
+	a.rows++
+	return nil
+}
+
+// release releases the elements reserved so far.
+func (a *arrayReservation) release() {
+	if a == nil {
+		return
+	}
+	a.h.releaseBuffer(a.bytes)
+	a.h.releaseRows(a.rows)
+	a.bytes, a.rows = 0, 0
+}
+
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// skipBOM discards the UTF-8 BOM that some Windows clients put at the start
+// of the body. Whitespace before the first row is kept so that the line
+// numbers of the errors do not change; parseLines skips the blank lines and
+// the decoder of a JSON array skips the whitespace.
+func skipBOM(br *bufio.Reader) {
+	if b, _ := br.Peek(len(utf8BOM)); bytes.Equal(b, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+}
+
+// isJSONArray reports whether the body starts with '[' after whitespace.
+func isJSONArray(br *bufio.Reader) bool {
+	for n := 1; n <= br.Size(); n++ {
+		b, _ := br.Peek(n)
+		if len(b) < n {
+			return false
+		}
+		switch b[n-1] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b[n-1] == '['
+	}
+	return false
+}
+
+// ProcessArray writes the elements of a JSON array body with writer.
+// The elements are decoded and written in chunks of -chunk-rows, so the
+// memory does not grow with the size of the array. The index of an error is the
+// position of the element. A syntax error stops the decoding with an error
+// for that element, and the elements before it are written.
+//
+// With opts.maxRows or opts.insertId the rows are written after the whole
+// array was read, so that an array over the limit fails with errTooManyRows
+// or errInsertIdMultipleRows without writing any row, like the other
+// bodies. At most opts.maxRows rows are held then.
+//
+// The held elements are reserved with opts.reservation. When the ceiling is
+// reached, the held rows are written to make room. If no row was written
+// yet, the array fails with errTooManyBufferedBytes or errTooManyQueuedRows;
+// otherwise the element gets the error and the rest of the array is not read.
+func ProcessArray(writer rowWriter, body io.Reader, opts *insertOptions) (*response, error) {
+	defer opts.reservation.release()
+
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	if _, err := dec.Token(); err != nil {
+		return buildResponse(nil, []*writeError{{Index: 0, Error: err}}, make([]*writeError, 0)), nil
+	}
+
+	// 本文を読む間はセマフォを持たず、読んだチャンクごとに書き込む
+	size := Options.ChunkRows
+	if size <= 0 {
+		size = defaultArrayChunkRows
+	}
+	// 上限を超えないと分かるまでは書き込まない
+	hold := opts.maxRows > 0 || opts.insertId != ""
+
+	sender := startSend(writer, opts)
+	pending := make([]*parsedRow, 0, size)
+	written := false
+	flush := func() {
+		if len(pending) > 0 {
+			written = true
+		}
+		for start := 0; start < len(pending); start += size {
+			end := start + size
+			if end > len(pending) {
+				end = len(pending)
+			}
+			acquireWrite()
+			for _, row := range pending[start:end] {
+				sender.send(row)
+			}
+			releaseWrite()
+		}
+		pending = pending[:0]
+		opts.reservation.release()
+	}
+
+	parseErrors := make([]*writeError, 0)
+	i := 0
+	for ; dec.More(); i++ {
+		if opts.maxRows > 0 && i >= opts.maxRows {
+			return nil, errTooManyRows
+		} else if opts.insertId != "" && i >= 1 {
+			return nil, errInsertIdMultipleRows
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			// 構文エラーの後は読み進められない
+			parseErrors = append(parseErrors, &writeError{Index: i, Error: err})
+			break
+		}
+		err := opts.reservation.reserve(int64(len(raw)))
+		if err != nil && !hold && len(pending) > 0 {
+			// 保持している行を書き込んで空きを作る
+			flush()
+			err = opts.reservation.reserve(int64(len(raw)))
+		}
+		if err != nil {
+			if !written {
+				return nil, err
+			}
+			parseErrors = append(parseErrors, &writeError{Index: i, Error: err, line: string(raw)})
+			break
+		}
+		value, err := decodeRow(string(raw))
+		if err != nil {
+			parseErrors = append(parseErrors, &writeError{Index: i, Error: err, line: string(raw)})
+			continue
+		}
+		pending = append(pending, &parsedRow{index: i, line: string(raw), value: value})
+		if !hold && len(pending) >= size {
+			flush()
+		}
+	}
+	flush()
+	errors := sender.finish()
+
+	resp := buildResponse(nil, parseErrors, errors)
+	resp.rows = i
+	return resp, nil
+}
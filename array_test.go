@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProcessArrayKeepsFailedElements(t *testing.T) {
+	writer := &fakeWriter{addErrs: []error{nil, fmt.Errorf("invalid row")}}
+	body := strings.NewReader(`[{"a": 1}, {"a": 2}, 42]`)
+	result, err := ProcessArray(writer, body, &insertOptions{table: "p/d/t"})
+	if err != nil {
+		t.Fatalf("ProcessArray() = %v", err)
+	}
+	if len(result.Errors) != 2 {
+		t.Fatalf("errors = %v, want 2", result.Errors)
+	}
+
+	// デッドレターに元の要素を書けるように保持する
+	want := []string{`{"a": 2}`, `42`}
+	for i, e := range result.Errors {
+		if e.Index != i+1 || e.line != want[i] {
+			t.Errorf("error %d = index %d line %q, want index %d line %q", i, e.Index, e.line, i+1, want[i])
+		}
+	}
+}
+
+func TestProcessArrayRejectsTooManyRows(t *testing.T) {
+	writer := &fakeWriter{}
+	body := strings.NewReader(`[{"a": 1}, {"a": 2}, {"a": 3}]`)
+	if _, err := ProcessArray(writer, body, &insertOptions{table: "p/d/t", maxRows: 2}); err != errTooManyRows {
+		t.Fatalf("ProcessArray() = %v, want errTooManyRows", err)
+	}
+	// 行ごとの本文と同じく、一部だけ書き込むことはしない
+	if len(writer.rows) != 0 {
+		t.Errorf("%d rows written before rejecting the array", len(writer.rows))
+	}
+
+	body = strings.NewReader(`[{"a": 1}, {"a": 2}]`)
+	result, err := ProcessArray(writer, body, &insertOptions{table: "p/d/t", maxRows: 2})
+	if err != nil || len(result.Errors) != 0 || len(writer.rows) != 2 {
+		t.Errorf("ProcessArray() = %v, %v with %d rows, want 2 rows written", result, err, len(writer.rows))
+	}
+}
+
+func TestProcessArrayReservesElements(t *testing.T) {
+	defer func(b, r int64) { Options.MaxBufferBytes, Options.MaxQueuedRows = b, r }(Options.MaxBufferBytes, Options.MaxQueuedRows)
+	h := newHttpHandler()
+
+	// 最初の要素も予約できなければ何も書き込まない
+	Options.MaxBufferBytes = 4
+	writer := &fakeWriter{}
+	body := strings.NewReader(`[{"a": 1}, {"a": 2}]`)
+	opts := &insertOptions{table: "p/d/t", reservation: &arrayReservation{h: h}}
+	if _, err := ProcessArray(writer, body, opts); err != errTooManyBufferedBytes {
+		t.Fatalf("ProcessArray() = %v, want errTooManyBufferedBytes", err)
+	}
+	if len(writer.rows) != 0 {
+		t.Errorf("%d rows written before rejecting the array", len(writer.rows))
+	}
+
+	// 上限に達したら保持している行を書き込んで続ける
+	Options.MaxBufferBytes = 0
+	Options.MaxQueuedRows = 2
+	writer = &fakeWriter{}
+	body = strings.NewReader(`[{"a": 1}, {"a": 2}, {"a": 3}]`)
+	opts = &insertOptions{table: "p/d/t", reservation: &arrayReservation{h: h}}
+	result, err := ProcessArray(writer, body, opts)
+	if err != nil || len(result.Errors) != 0 || len(writer.rows) != 3 {
+		t.Errorf("ProcessArray() = %v, %v with %d rows, want 3 rows written", result, err, len(writer.rows))
+	}
+
+	if n := atomic.LoadInt64(&h.bufferedBytes); n != 0 {
+		t.Errorf("%d bytes still buffered after the array", n)
+	}
+	if n := atomic.LoadInt64(&h.queuedRows); n != 0 {
+		t.Errorf("%d rows still queued after the array", n)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serveAsync accepts the rows of an ?async=1 request and writes them in
+// the background. The response is 202 Accepted before the rows are added,
+// so the errors are only logged and counted in the metrics.
+func (h *httpHandler) serveAsync(w http.ResponseWriter, r *http.Request, project, dataset, table string, opts *insertOptions, body *requestBody) {
+	if opts.route && body.array != nil {
+		h.badRequest(w, r, errArrayRoute.Error())
+		return
+	}
+
+	// レスポンスを返した後はリクエストの本文を読めない
+	body, err := body.buffer()
+	if isTimeout(err) {
+		h.requestTimeout(w, r, "timeout reading request body")
+		return
+	} else if err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	}
+
+	// 書き込みが終わるまで、ServeHTTPでの予約を引き継いで本文を保持する
+	// JSON配列はここで読んだので、ここで予約する
+	queued := body.take()
+	if queued.array != nil {
+		if !h.reserveBuffer(int64(len(queued.data))) {
+			h.tooManyRequests(w, r, errTooManyBufferedBytes.Error())
+			return
+		}
+		queued.reservedBytes = int64(len(queued.data))
+	}
+	releaseQueue := func() {
+		h.releaseBody(queued)
+	}
+
+	// 202を返した後では行数などの誤りをクライアントに返せない
+	if queued.array == nil {
+		if _, err := splitLines(queued.data, opts); err != nil {
+			releaseQueue()
+			h.batchError(w, r, opts, err)
+			return
+		}
+	}
+
+	var writer *writerEntry
+	if !opts.route {
+		writer, err = h.getBigqueryWriter(opts.credential, project, dataset, table)
+		if err == errTooManyTables {
+			releaseQueue()
+			h.serviceUnavailable(w, r, err.Error())
+			return
+		} else if err == errDatasetNotFound {
+			releaseQueue()
+			h.badRequest(w, r, err.Error())
+			return
+		} else if err != nil {
+			releaseQueue()
+			h.internalError(w, r, err.Error())
+			return
+		}
+		if !writer.breaker.allow() {
+			writer.release()
+			releaseQueue()
+			h.serviceUnavailable(w, r, errBreakerOpen.Error())
+			return
+		}
+	}
+
+	// 非同期ではstreamの途中経過は返さない
+	async := *opts
+	async.stream = nil
+	if queued.array != nil {
+		// 本文のバイト数は予約済みなので行数だけ予約する
+		async.reservation = &arrayReservation{h: h, rowsOnly: true}
+	}
+
+	// 結果は/status/{id}で確認できる
+	id := generateInsertId(16)
+	h.batches.add(id, project)
+
+	h.async.Add(1)
+	go func() {
+		defer h.async.Done()
+		defer releaseQueue()
+		result, err := h.writeAsync(project, dataset, table, &async, queued, writer)
+		h.batches.resolve(id, result, err)
+	}()
+
+	logger.Debugf("accepted %s as %s", opts.table, id)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Location", "/status/"+id)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf(`{"accepted": true, "id": %q}`, id)))
+}
+
+func (h *httpHandler) writeAsync(project, dataset, table string, opts *insertOptions, body *requestBody, writer *writerEntry) (*response, error) {
+	var result *response
+	var err error
+	if opts.route {
+		result, err = h.processRoutedBatch(project, dataset, table, body.data, opts)
+	} else {
+		defer writer.release()
+		if body.array != nil {
+			result, err = ProcessArray(writer, body.array, opts)
+		} else {
+			result, err = ProcessBatch(writer, body.data, opts)
+		}
+	}
+
+	h.finishAsync(opts.table, result, err)
+	return result, err
+}
+
+// finishAsync reports the result of a write that has no response to carry
+// it. The errors are only logged and counted in the metrics.
+func (h *httpHandler) finishAsync(table string, result *response, err error) {
+	if err != nil {
+		logger.Errorf("async %s: %v", table, err)
+		h.metrics.asyncFailed()
+		return
+	}
+
+	h.webhook.notify(table, result)
+	h.writeDeadLetters(table, result)
+	h.recentErrors.add(table, result.Errors)
+
+	if len(result.Errors) > 0 {
+		logger.Errorf("async %s: %d of %d rows failed: %v",
+			table, len(result.Errors), result.rows, result.Errors[0].Error)
+		h.metrics.asyncRowFailed(len(result.Errors))
+	}
+}
+
+// asyncBatch is the state of a batch accepted with ?async=1.
+type asyncBatch struct {
+	project string
+	expires time.Time
+
+	State  string        `json:"state"`
+	Error  string        `json:"error,omitempty"`
+	Errors []*writeError `json:"errors,omitempty"`
+}
+
+// asyncBatches keeps the state of async batches for -async-status-ttl
+// after they were accepted, so that the map does not grow without limit.
+type asyncBatches struct {
+	mu      sync.Mutex
+	batches map[string]*asyncBatch
+	swept   time.Time
+}
+
+func (b *asyncBatches) add(id, project string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.batches == nil {
+		b.batches = make(map[string]*asyncBatch)
+	}
+	if now.Sub(b.swept) >= time.Minute {
+		for key, batch := range b.batches {
+			if now.After(batch.expires) {
+				delete(b.batches, key)
+			}
+		}
+		b.swept = now
+	}
+	b.batches[id] = &asyncBatch{
+		project: project,
+		expires: now.Add(Options.AsyncStatusTTL),
+		State:   "pending",
+	}
+}
+
+func (b *asyncBatches) resolve(id string, result *response, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	batch, ok := b.batches[id]
+	if !ok {
+		return
+	}
+	if err != nil {
+		batch.State = "failed"
+		batch.Error = err.Error()
+	} else if len(result.Errors) > 0 {
+		result.truncateErrors(Options.MaxErrors)
+		batch.State = "failed"
+		batch.Errors = result.Errors
+	} else {
+		batch.State = "succeeded"
+	}
+}
+
+// get returns a copy of the state of the batch.
+func (b *asyncBatches) get(id string) (asyncBatch, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	batch, ok := b.batches[id]
+	if !ok || time.Now().After(batch.expires) {
+		return asyncBatch{}, false
+	}
+	return *batch, true
+}
+
+// serveBatchStatus handles GET /status/{id} for an async batch.
+func (h *httpHandler) serveBatchStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.methodNotAllowed(w, r, "method not allowed")
+		return
+	}
+
+	batch, ok := h.batches.get(strings.TrimPrefix(r.URL.Path, "/status/"))
+	if !ok {
+		h.notFound(w, r, "batch not found")
+		return
+	}
+	switch authorizeProject(r, batch.project) {
+	case http.StatusUnauthorized:
+		h.unauthorized(w, r, "unauthorized")
+		return
+	case http.StatusForbidden:
+		h.forbidden(w, r, "project is not allowed")
+		return
+	}
+
+	body, err := json.Marshal(&batch)
+	if err != nil {
+		h.internalError(w, r, err.Error())
+		return
+	}
+	h.ok(w, body)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestServeAsync(t *testing.T) {
+	defer func(f func(string, string, string) bigqueryWriter) { newWriter = f }(newWriter)
+	writer := &fakeWriter{}
+	newWriter = func(project, dataset, table string) bigqueryWriter { return writer }
+	defer func(bytes int64, rows int) {
+		Options.MaxBufferBytes, Options.MaxRows = bytes, rows
+	}(Options.MaxBufferBytes, Options.MaxRows)
+	Options.MaxBufferBytes = 30
+	Options.MaxRows = 2
+
+	h := newHttpHandler()
+	h.setReady(true)
+	post := func(body string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/p/d/t?async=1", strings.NewReader(body)))
+		return w.Code
+	}
+
+	// 本文は-max-buffer-bytesに対して一度だけ数える
+	if code := post(`{"a": 1}` + "\n" + `{"a": 2}` + "\n"); code != http.StatusAccepted {
+		t.Errorf("status = %d, want 202", code)
+	}
+	h.async.Wait()
+	if len(writer.rows) != 2 {
+		t.Errorf("%d rows written, want 2", len(writer.rows))
+	}
+	if n := atomic.LoadInt64(&h.bufferedBytes); n != 0 {
+		t.Errorf("%d bytes still buffered", n)
+	}
+
+	// 受け付ける前に行数を確認する
+	if code := post("{}\n{}\n{}\n"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", code)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// tokenGrant is what a token of the -token-file may do: the projects it may
+// write to, and the named credentials it may select with X-Credential.
+// "*" allows every project or every credential.
+type tokenGrant struct {
+	Projects    []string `json:"projects"`
+	Credentials []string `json:"credentials"`
+}
+
+// UnmarshalJSON also accepts a list of projects, the format of the file
+// before the credentials were added. Such a token may only use the
+// default credential.
+func (g *tokenGrant) UnmarshalJSON(data []byte) error {
+	if isJSONArrayBytes(data) {
+		return json.Unmarshal(data, &g.Projects)
+	}
+	type plain tokenGrant
+	return json.Unmarshal(data, (*plain)(g))
+}
+
+// loadTokenFile reads the grants of the tokens. The file is a JSON object
+// like {"token": {"projects": ["project"], "credentials": ["name"]}}, or
+// {"token": ["project", ...]} for a token without named credentials.
+func loadTokenFile(path string) (map[string]*tokenGrant, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make(map[string]*tokenGrant)
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, err
+	}
+	for _, grant := range tokens {
+		// トークン自体はログに出さない
+		if grant == nil {
+			return nil, fmt.Errorf("token file has a null grant")
+		}
+	}
+	return tokens, nil
+}
+
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimPrefix(auth, "Bearer ")
+}
+
+// authorizeProject checks the bearer token of an insert request.
+// It returns the status code to respond with, or 0 if the request
+// is allowed. Inserts are open when no token file is configured.
+func authorizeProject(r *http.Request, project string) int {
+	if Options.Tokens == nil {
+		return 0
+	}
+	grant, ok := Options.Tokens[bearerToken(r)]
+	if !ok {
+		return http.StatusUnauthorized
+	}
+	for _, p := range grant.Projects {
+		if p == project || p == "*" {
+			return 0
+		}
+	}
+	return http.StatusForbidden
+}
+
+// authorizeCredential checks that the bearer token of an insert request
+// may use the named credential, like authorizeProject. The default
+// credential "" is allowed to every token, and any credential is allowed
+// when no token file is configured.
+func authorizeCredential(r *http.Request, credential string) int {
+	if Options.Tokens == nil || credential == "" {
+		return 0
+	}
+	grant, ok := Options.Tokens[bearerToken(r)]
+	if !ok {
+		return http.StatusUnauthorized
+	}
+	for _, c := range grant.Credentials {
+		if c == credential || c == "*" {
+			return 0
+		}
+	}
+	return http.StatusForbidden
+}
+
+// isDatasetAllowed reports whether the proxy may write to the dataset.
+// Every dataset is allowed when -allow-datasets is empty.
+func isDatasetAllowed(dataset string) bool {
+	return len(Options.AllowDatasets) == 0 || Options.AllowDatasets[dataset]
+}
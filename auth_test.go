@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthorizeCredential(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	data := `{"a": {"projects": ["p"], "credentials": ["writer-a"]}, "b": ["p"]}`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := loadTokenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(tokens map[string]*tokenGrant) { Options.Tokens = tokens }(Options.Tokens)
+	Options.Tokens = tokens
+
+	tests := []struct {
+		token, credential string
+		want              int
+	}{
+		{"a", "", 0},
+		{"a", "writer-a", 0},
+		{"a", "writer-b", http.StatusForbidden},
+		{"b", "", 0},
+		{"b", "writer-a", http.StatusForbidden},
+		{"c", "writer-a", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/p/d/t", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		if got := authorizeCredential(r, tt.credential); got != tt.want {
+			t.Errorf("token %s credential %q: %d, want %d", tt.token, tt.credential, got, tt.want)
+		}
+		if got := authorizeProject(r, "p"); tt.token != "c" && got != 0 {
+			t.Errorf("token %s: project %d, want allowed", tt.token, got)
+		}
+	}
+}
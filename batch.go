@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errTooManyRows          = fmt.Errorf("too many rows")
+	errInsertIdMultipleRows = fmt.Errorf("X-Insert-Id is allowed only for a single row")
+	errRowNotObject         = fmt.Errorf("row must be a JSON object")
+	errBodyNotJSON          = fmt.Errorf("body is not JSON")
+	errTruncatedBody        = fmt.Errorf("truncated body")
+)
+
+// writeSem limits the number of sendLines running at the same time across
+// all tables. It is acquired once per batch of a destination, or per chunk
+// of a JSON array body after the chunk is read, so it bounds concurrent
+// batches, not rows. It is independent of any per-table or per-request
+// limit and a batch must pass all of them. nil means no limit.
+var writeSem chan struct{}
+
+func initWriteSemaphore(size int) {
+	if size > 0 {
+		writeSem = make(chan struct{}, size)
+	}
+}
+
+func acquireWrite() {
+	if writeSem != nil {
+		writeSem <- struct{}{}
+	}
+}
+
+func releaseWrite() {
+	if writeSem != nil {
+		<-writeSem
+	}
+}
+
+// rowWriter is the part of the BigQuery writer used to insert rows.
+type rowWriter interface {
+	Add(insertId string, row map[string]interface{}) error
+}
+
+// ProcessBatch writes the JSON lines in body with writer. It has no HTTP
+// concerns so that the row processing can be benchmarked and fuzzed.
+// It returns errTooManyRows when the body has more rows than opts.maxRows,
+// errInsertIdMultipleRows when opts.insertId is set for several rows, and
+// errBodyNotJSON when the body is clearly not JSON lines.
+func ProcessBatch(writer rowWriter, body []byte, opts *insertOptions) (*response, error) {
+	lines, err := splitLines(body, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, parseErrors := parseLines(lines)
+	errors := sendLines(writer, rows, opts)
+	return buildResponse(lines, parseErrors, errors), nil
+}
+
+// buildResponse merges the parse errors and the write errors of a batch.
+// With -ignore-parse-errors the parse errors are returned as warnings so
+// that clients checking errors see success.
+func buildResponse(lines []string, parseErrors, errors []*writeError) *response {
+	resp := &response{rows: countRows(lines), lines: lines}
+	if Options.IgnoreParseErrors {
+		if len(parseErrors) > 0 {
+			logger.Infof("ignored %d unparseable lines", len(parseErrors))
+		}
+		resp.Warnings = parseErrors
+	} else {
+		errors = append(parseErrors, errors...)
+	}
+	sortWriteErrors(errors)
+	resp.Errors = errors
+	return resp
+}
+
+// splitLines splits body into lines, and checks the number of rows.
+func splitLines(body []byte, opts *insertOptions) ([]string, error) {
+	// HTMLのエラーページなどを送ってくる設定ミスは行ごとのエラーにしない
+	if isMarkup(body) {
+		return nil, errBodyNotJSON
+	}
+	lines := strings.Split(string(body), "\n")
+	n := countRows(lines)
+	if opts.maxRows > 0 && n > opts.maxRows {
+		return nil, errTooManyRows
+	} else if opts.insertId != "" && n > 1 {
+		return nil, errInsertIdMultipleRows
+	}
+	return lines, nil
+}
+
+// isMarkup reports whether body starts with '<' after whitespace, such as
+// an HTML error page. JSON never starts with '<'.
+func isMarkup(body []byte) bool {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '<'
+
+}
+
+// countBodyRows counts the non-blank lines of body without splitting it.
+func countBodyRows(body []byte) int {
+	n := 0
+	for len(body) > 0 {
+		line := body
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			line, body = body[:i], body[i+1:]
+		} else {
+			body = nil
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func countRows(lines []string) int {
+	n := 0
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// parsedRow is a JSON line decoded into a row.
+type parsedRow struct {
+	index int
+	line  string
+	value map[string]interface{}
+}
+
+// parseLines decodes each JSON line. The index of a row is its line number
+// in the request body, and blank lines are skipped. A last line that ends
+// in the middle of an object fails with errTruncatedBody, as the client
+// most likely disconnected.
+func parseLines(lines []string) ([]*parsedRow, []*writeError) {
+	rows := make([]*parsedRow, 0, len(lines))
+	errors := make([]*writeError, 0)
+	for i, line := range lines {
+		// 空行はエラーにせず、行番号も変えない
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		value, err := decodeRow(line)
+		if err != nil {
+			if i == len(lines)-1 && isTruncatedLine(line) {
+				err = errTruncatedBody
+			}
+			errors = append(errors, &writeError{Index: i, Error: err})
+			continue
+		}
+		rows = append(rows, &parsedRow{index: i, line: line, value: value})
+	}
+	return rows, errors
+}
+
+// isTruncatedLine reports whether line has more opening braces or brackets
+// than closing ones, or ends inside a string.
+func isTruncatedLine(line string) bool {
+	depth := 0
+	inString, escaped := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if inString {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+		}
+	}
+	return inString || depth > 0
+}
+
+// decodeRow decodes a JSON line. Numbers are kept as json.Number so that
+// large integers do not lose precision as float64. encoding/json writes
+// json.Number back as a number literal when the writer sends the row.
+func decodeRow(line string) (map[string]interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var value map[string]interface{}
+	if err := dec.Decode(&value); err != nil {
+		if _, ok := err.(*json.UnmarshalTypeError); ok {
+			// 配列や数値などの正しいJSON
+			return nil, errRowNotObject
+		}
+		return nil, err
+	} else if value == nil {
+		// null
+		return nil, errRowNotObject
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("invalid data after top-level value")
+	}
+	return value, nil
+}
+
+// sendLines writes the rows to BigQuery. The insertId of each row is chosen
+// by the strategy of the table, or from opts.keyField for PUT requests.
+//
+// A large batch is split into chunks of -chunk-rows rows, and up to
+// -chunk-concurrency chunks are written at the same time. The writer is
+// safe for concurrent Add calls, as requests for a table share it. The
+// errors are sorted by the row index later, so their order does not matter.
+func sendLines(writer rowWriter, rows []*parsedRow, opts *insertOptions) []*writeError {
+	acquireWrite()
+	defer releaseWrite()
+
+	sender := startSend(writer, opts)
+	if Options.ChunkConcurrency <= 1 || Options.ChunkRows <= 0 || len(rows) <= Options.ChunkRows {
+		for _, row := range rows {
+			sender.send(row)
+		}
+		return sender.finish()
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, Options.ChunkConcurrency)
+	for start := 0; start < len(rows); start += Options.ChunkRows {
+		end := start + Options.ChunkRows
+		if end > len(rows) {
+			end = len(rows)
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(chunk []*parsedRow) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			for _, row := range chunk {
+				sender.send(row)
+			}
+		}(rows[start:end])
+	}
+	wg.Wait()
+	return sender.finish()
+}
+
+// rowSender writes rows of a batch one by one, so that a batch can be
+// written while it is decoded.
+type rowSender struct {
+	writer   rowWriter
+	opts     *insertOptions
+	config   *tableConfig
+	strategy string
+	idLength int
+	schema   tableSchema
+
+	// チャンクを並行して書き込むときに保護する
+	mu      sync.Mutex
+	learned tableSchema
+	errors  []*writeError
+}
+
+// startSend starts sending the rows of a batch. finish must be called.
+// The caller holds the global write semaphore while it sends the rows.
+func startSend(writer rowWriter, opts *insertOptions) *rowSender {
+	config := tableConfigFor(opts.table)
+	s := &rowSender{
+		writer:   writer,
+		opts:     opts,
+		config:   config,
+		strategy: config.InsertId,
+		idLength: config.idLength(),
+		errors:   make([]*writeError, 0),
+	}
+
+	// PUTではキーのフィールドを使う
+	if opts.keyField != "" {
+		s.strategy = "field:" + opts.keyField
+	}
+
+	if Options.InferSchema {
+		s.schema = schemas.get(opts.table)
+		if s.schema == nil {
+			s.learned = make(tableSchema)
+		}
+	}
+	return s
+}
+
+func (s *rowSender) send(row *parsedRow) {
+	if Options.StripFieldPrefix != "" {
+		stripFieldPrefix(row.value, Options.StripFieldPrefix)
+	}
+	s.config.applyRename(row.value)
+
+	// 個人情報などテーブルに入れてはいけないフィールド
+	err := s.config.applyDenyFields(row.value)
+	if err == nil && s.schema != nil {
+		err = s.schema.validate(row.value)
+	}
+	if err == nil && Options.MaxRowAge > 0 {
+		err = checkRowAge(row.value, time.Now())
+	}
+	if err == nil {
+		err = sendRow(s.writer, row, s.strategy, s.idLength, s.opts)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors = append(s.errors, &writeError{Index: row.index, Error: err, line: row.line})
+	} else if s.learned != nil {
+		s.learned.observe(row.value)
+	}
+	if s.opts.stream != nil {
+		s.opts.stream.row(err)
+	}
+}
+
+// finish returns the errors of the rows.
+func (s *rowSender) finish() []*writeError {
+	// 最初に全行成功したバッチからスキーマを推測する
+	if s.learned != nil && len(s.learned) > 0 && len(s.errors) == 0 {
+		schemas.learn(s.opts.table, s.learned)
+	}
+	return s.errors
+}
+
+// sendRow writes the row. Random insertIds have idLength characters.
+func sendRow(writer rowWriter, row *parsedRow, strategy string, idLength int, opts *insertOptions) error {
+	insertId := opts.insertId
+	if insertId == "" {
+		id, err := insertIdFor(strategy, row.value, idLength)
+		if err != nil {
+			return err
+		}
+		insertId = id
+	}
+	if opts.sample && rand.Float64() < Options.SampleRate {
+		logger.Debugf("sample %s: %s", opts.table, row.line)
+	}
+
+	err := addWithRetry(writer, insertId, row.value, opts.retries)
+
+	// ランダムなinsertIdのみ作り直して再試行する
+	// 指定されたinsertIdを変えると重複排除が効かなくなる
+	random := (strategy == "" || strategy == "random") && opts.insertId == ""
+	for i := 0; err != nil && random && i < Options.InsertIdRetries && isInsertIdError(err); i++ {
+		insertId = generateInsertId(idLength)
+		err = addWithRetry(writer, insertId, row.value, opts.retries)
+	}
+	return err
+}
+
+// stripFieldPrefix removes prefix from the top-level keys of the row.
+// Keys without the prefix are left unchanged.
+func stripFieldPrefix(row map[string]interface{}, prefix string) {
+	// 走査中に追加したキーを再度処理しないように先に集める
+	keys := make([]string, 0)
+	for key := range row {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		value := row[key]
+		delete(row, key)
+		row[strings.TrimPrefix(key, prefix)] = value
+	}
+}
+
+// checkRowAge rejects rows whose time field is older than -max-row-age.
+// The field is a UNIX time in seconds or an RFC 3339 string.
+func checkRowAge(row map[string]interface{}, now time.Time) error {
+	value, ok := row[Options.RowTimeField]
+	if !ok || value == nil {
+		if Options.RowTimeStrict {
+			return fmt.Errorf("time field %s is missing", Options.RowTimeField)
+		}
+		return nil
+	}
+
+	var t time.Time
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("time field %s is invalid: %v", Options.RowTimeField, err)
+		}
+		t = time.Unix(int64(f), 0)
+	case string:
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return fmt.Errorf("time field %s is invalid: %v", Options.RowTimeField, err)
+		}
+		t = parsed
+	default:
+		return fmt.Errorf("time field %s is invalid", Options.RowTimeField)
+	}
+
+	if now.Sub(t) > Options.MaxRowAge {
+		return fmt.Errorf("row is older than %v", Options.MaxRowAge)
+	}
+	return nil
+}
+
+// backendErrorで再試行する際の初回の待ち時間
+const addRetryInterval = time.Millisecond * 100
+
+// rateLimitExceededで再試行する際の初回の待ち時間
+const rateLimitRetryInterval = time.Second
+
+// addWithRetry adds the row, retrying up to retries times only when
+// BigQuery returned a backendError or a rate limit error. The rate limit
+// errors are retried after the delay suggested by BigQuery, or with a
+// longer backoff when it suggested none. A suggested delay longer than
+// -rate-limit-retry-after is not waited for, and the error is returned so
+// that the client gets the delay in Retry-After.
+func addWithRetry(writer rowWriter, insertId string, row map[string]interface{}, retries int) error {
+	interval := addRetryInterval
+	for i := 0; ; i++ {
+		err := writer.Add(insertId, row)
+		if err == nil || i >= retries {
+			return err
+		} else if isRateLimitError(err) {
+			if delay, ok := retryDelay(err); ok {
+				if delay > Options.RateLimitRetry {
+					return err
+				}
+				time.Sleep(delay)
+				continue
+			}
+			if interval < rateLimitRetryInterval {
+				interval = rateLimitRetryInterval
+			}
+		} else if !isBackendError(err) {
+			return err
+		}
+		time.Sleep(jitter(interval))
+		interval *= 2
+	}
+}
+
+// jitter returns a random duration between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
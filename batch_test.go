@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProcessBatchKeepsLargeIntegers(t *testing.T) {
+	writer := &fakeWriter{}
+	result, err := ProcessBatch(writer, []byte(`{"id": 1234567890123456789}`), &insertOptions{table: "p/d/t"})
+	if err != nil {
+		t.Fatalf("ProcessBatch() = %v", err)
+	} else if len(result.Errors) != 0 {
+		t.Fatalf("errors = %v", result.Errors)
+	}
+
+	if len(writer.rows) != 1 {
+		t.Fatalf("%d rows written, want 1", len(writer.rows))
+	}
+	// float64では1234567890123456800になる
+	if id := writer.rows[0]["id"]; id != json.Number("1234567890123456789") {
+		t.Errorf("id = %#v, want json.Number(\"1234567890123456789\")", id)
+	}
+}
+
+// latencyWriter discards the rows, and sleeps on every 100th row like a
+// writer flushing its buffer to BigQuery.
+type latencyWriter struct {
+	rows int64
+}
+
+func (w *latencyWriter) Add(insertId string, row map[string]interface{}) error {
+	if atomic.AddInt64(&w.rows, 1)%100 == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+func BenchmarkProcessBatch(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&buf, `{"id": %d, "name": "row%d"}`+"\n", i, i)
+	}
+	body := buf.Bytes()
+
+	defer func(rows, concurrency int) {
+		Options.ChunkRows, Options.ChunkConcurrency = rows, concurrency
+	}(Options.ChunkRows, Options.ChunkConcurrency)
+	Options.ChunkRows = 500
+
+	for _, concurrency := range []int{1, 8} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			Options.ChunkConcurrency = concurrency
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				if _, err := ProcessBatch(&latencyWriter{}, body, &insertOptions{table: "p/d/t"}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func FuzzProcessBatch(f *testing.F) {
+	f.Add([]byte(`{"a": 1}`))
+	f.Add([]byte("{\"a\": 1}\n{\"b\": [1, 2]}\n"))
+	f.Add([]byte("42\n[1,2]\nnull\n{\"a\": \"x"))
+	f.Add([]byte("\xef\xbb\xbf{\"a\": 1}\r\n\r\n"))
+	f.Add([]byte("<html><body>error</body></html>"))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		writer := &fakeWriter{}
+		result, err := ProcessBatch(writer, body, &insertOptions{table: "p/d/t", maxRows: 1000})
+		if err != nil {
+			return
+		}
+
+		// 1行につき書き込みもエラーも高々1つ
+		lines := bytes.Count(body, []byte("\n")) + 1
+		if len(writer.rows) > lines {
+			t.Fatalf("%d rows written from %d lines", len(writer.rows), lines)
+		}
+		for _, e := range result.Errors {
+			if e.Index < 0 || e.Index >= lines {
+				t.Fatalf("error index %d out of %d lines", e.Index, lines)
+			}
+		}
+		if len(result.Errors)+len(writer.rows) > lines {
+			t.Fatalf("%d errors and %d rows from %d lines", len(result.Errors), len(writer.rows), lines)
+		}
+	})
+}
+
+func TestProcessBatchSkipsBlankLines(t *testing.T) {
+	writer := &fakeWriter{}
+	result, err := ProcessBatch(writer, []byte("\r\n{\"a\": 1}\n\n{\"b\": \n"), &insertOptions{table: "p/d/t"})
+	if err != nil {
+		t.Fatalf("ProcessBatch() = %v", err)
+	}
+	if len(writer.rows) != 1 {
+		t.Errorf("%d rows written, want 1", len(writer.rows))
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Index != 3 {
+		t.Errorf("errors = %v, want only the error of line 3", result.Errors)
+	}
+}
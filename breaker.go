@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var errBreakerOpen = fmt.Errorf("circuit breaker is open")
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker stops writes to a table after consecutive failures.
+// After the cooldown one request is let through to test the table.
+type breaker struct {
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func (b *breaker) allow() bool {
+	if Options.BreakerThreshold <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerClosed {
+		return true
+	} else if time.Since(b.openedAt) < Options.BreakerCooldown {
+		return false
+	}
+
+	// half-openのリクエストが結果を返さなかった場合も
+	// cooldownが過ぎれば再度試す
+	b.state = breakerHalfOpen
+	b.openedAt = time.Now()
+	return true
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+func (b *breaker) failure() {
+	if Options.BreakerThreshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= Options.BreakerThreshold {
+		if b.state != breakerOpen {
+			logger.Warnf("circuit breaker opened after %d failures", b.failures)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// connLimiter limits the connections from each remote IP. It is used as
+// the ConnState hook of the server, and closes a new connection over the
+// limit before any request on it is read.
+type connLimiter struct {
+	mu    sync.Mutex
+	max   int
+	conns map[string]int
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, conns: make(map[string]int)}
+}
+
+func (l *connLimiter) connState(c net.Conn, state http.ConnState) {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		// unixソケットなどIPのない接続は数えない
+		return
+	}
+
+	switch state {
+	case http.StateNew:
+		l.mu.Lock()
+		l.conns[host]++
+		n := l.conns[host]
+		l.mu.Unlock()
+		if n > l.max {
+			// 閉じた接続もStateClosedで数を戻す
+			logger.Warnf("too many connections from %s", host)
+			c.Close()
+		}
+	case http.StateClosed, http.StateHijacked:
+		l.mu.Lock()
+		if l.conns[host]--; l.conns[host] <= 0 {
+			delete(l.conns, host)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// connQuota counts the requests and the rows submitted on a connection.
+type connQuota struct {
+	requests int64
+	rows     int64
+}
+
+type connQuotaKey struct{}
+
+// connQuotas closes a keep-alive connection once it has submitted more
+// than -max-conn-requests requests or -max-conn-rows rows, so that one
+// client can not stream on a connection forever. The response of the
+// request reaching the quota has "Connection: close", so that the client
+// does not send another request on the connection.
+type connQuotas struct {
+	mu     sync.Mutex
+	quotas map[net.Conn]*connQuota
+}
+
+func newConnQuotas() *connQuotas {
+	return &connQuotas{quotas: make(map[net.Conn]*connQuota)}
+}
+
+// connContext is the ConnContext hook of the server. The handler finds the
+// quota of the connection in the context of the request.
+func (q *connQuotas) connContext(ctx context.Context, c net.Conn) context.Context {
+	quota := &connQuota{}
+	q.mu.Lock()
+	q.quotas[c] = quota
+	q.mu.Unlock()
+	return context.WithValue(ctx, connQuotaKey{}, quota)
+}
+
+func (q *connQuotas) connState(c net.Conn, state http.ConnState) {
+	q.mu.Lock()
+	quota, ok := q.quotas[c]
+	if state == http.StateClosed || state == http.StateHijacked {
+		delete(q.quotas, c)
+	}
+	q.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if state == http.StateActive {
+		atomic.AddInt64(&quota.requests, 1)
+	}
+}
+
+func (q *connQuota) exceeded() bool {
+	if Options.MaxConnRequests > 0 && atomic.LoadInt64(&q.requests) >= Options.MaxConnRequests {
+		return true
+	}
+	return Options.MaxConnRows > 0 && atomic.LoadInt64(&q.rows) >= Options.MaxConnRows
+}
+
+// addConnRows counts the rows submitted by the request on its connection.
+// It must be called before the response is written.
+func addConnRows(w http.ResponseWriter, r *http.Request, rows int) {
+	if quota, ok := r.Context().Value(connQuotaKey{}).(*connQuota); ok {
+		atomic.AddInt64(&quota.rows, int64(rows))
+		checkConnQuota(w, r)
+	}
+}
+
+// checkConnQuota closes the connection after the response when it has
+// reached the quota.
+func checkConnQuota(w http.ResponseWriter, r *http.Request) {
+	if quota, ok := r.Context().Value(connQuotaKey{}).(*connQuota); ok && quota.exceeded() {
+		logger.Infof("closing connection from %s: quota exceeded", r.RemoteAddr)
+		w.Header().Set("Connection", "close")
+	}
+}
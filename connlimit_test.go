@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestConnQuotaClosesAfterResponse(t *testing.T) {
+	defer func(f func(string, string, string) bigqueryWriter) { newWriter = f }(newWriter)
+	newWriter = func(project, dataset, table string) bigqueryWriter { return &fakeWriter{} }
+	defer func(requests, rows int64) {
+		Options.MaxConnRequests, Options.MaxConnRows = requests, rows
+	}(Options.MaxConnRequests, Options.MaxConnRows)
+
+	h := newHttpHandler()
+	h.setReady(true)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Options.MaxConnRequests = 2
+	Options.MaxConnRows = 3
+	srv := newServer(h)
+	go srv.Serve(ln)
+	defer srv.Close()
+	url := "http://" + ln.Addr().String()
+
+	// 応答で閉じることを伝えるので、次のリクエストは新しい接続で送られる
+	client := &http.Client{Transport: &http.Transport{}}
+	for i, want := range []bool{false, true, false} {
+		resp, err := client.Get(url + "/livez")
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		resp.Body.Close()
+		if resp.Close != want {
+			t.Errorf("request %d: close = %v, want %v", i, resp.Close, want)
+		}
+	}
+
+	// 新しい接続の最初のリクエストでも行数で閉じる
+	client = &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Post(url+"/p/d/t", "application/json", strings.NewReader("{}\n{}\n{}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !resp.Close {
+		t.Errorf("status = %d, close = %v, want 200 and close after 3 rows", resp.StatusCode, resp.Close)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// credential is a service account in the -credentials file, a JSON object
+// keyed by the name that clients send in the X-Credential header.
+type credential struct {
+	Email   string `json:"email"`
+	PemFile string `json:"pem_file"`
+	Pem     []byte `json:"-"`
+}
+
+func loadCredentials(path string) (map[string]*credential, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	creds := make(map[string]*credential)
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, err
+	}
+	for name, cred := range creds {
+		if cred.Email == "" || cred.PemFile == "" {
+			return nil, fmt.Errorf("credential %s: email and pem_file required", name)
+		}
+		pem, err := ioutil.ReadFile(cred.PemFile)
+		if err != nil {
+			return nil, fmt.Errorf("credential %s: %v", name, err)
+		} else if _, err := parsePrivateKey(pem); err != nil {
+			return nil, fmt.Errorf("credential %s: invalid pem %s: %v", name, cred.PemFile, err)
+		}
+		cred.Pem = pem
+	}
+	return creds, nil
+}
+
+// credentialFor returns the email and the PEM of the named credential.
+// The empty name is the default -email and -pem.
+func credentialFor(name string) (string, []byte, error) {
+	if name == "" {
+		return Options.Email, Options.Pem, nil
+	}
+	cred, ok := Options.Credentials[name]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown credential %s", name)
+	}
+	return cred.Email, cred.Pem, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var errDatasetNotFound = fmt.Errorf("dataset not found")
+
+// 存在しないデータセットは作成されるかもしれないので一定時間だけ覚える
+const datasetNotFoundTTL = time.Minute
+
+// datasetCache remembers which datasets exist, so that the metadata call
+// of -check-dataset is made once per dataset instead of once per writer.
+type datasetCache struct {
+	mu      sync.Mutex
+	exists  map[string]bool
+	checked map[string]time.Time
+}
+
+// checkDataset returns errDatasetNotFound when the dataset does not exist.
+// It uses the default credential, which must be able to see the datasets.
+func (c *datasetCache) checkDataset(api *bigqueryAPI, project, dataset string) error {
+	key := project + "/" + dataset
+
+	c.mu.Lock()
+	if c.exists == nil {
+		c.exists = make(map[string]bool)
+		c.checked = make(map[string]time.Time)
+	}
+	exists, ok := c.exists[key]
+	if ok && (exists || time.Since(c.checked[key]) < datasetNotFoundTTL) {
+		c.mu.Unlock()
+		if !exists {
+			return errDatasetNotFound
+		}
+		return nil
+	}
+	c.mu.Unlock()
+
+	path := "/projects/" + url.PathEscape(project) + "/datasets/" + url.PathEscape(dataset)
+	err := api.call("GET", path, nil, nil)
+	if e, ok := err.(*apiError); ok && e.StatusCode == http.StatusNotFound {
+		exists = false
+	} else if err != nil {
+		return err
+	} else {
+		exists = true
+	}
+
+	c.mu.Lock()
+	c.exists[key] = exists
+	c.checked[key] = time.Now()
+	c.mu.Unlock()
+
+	if !exists {
+		return errDatasetNotFound
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+)
+
+// writeDeadLetters writes the rows that failed to parse or insert to the
+// -deadletter-table, with the error message and the original line, so that
+// rejected rows are kept even if the client does not persist them.
+// The rows are written in the background so that the response is not
+// delayed by the dead-letter table.
+func (h *httpHandler) writeDeadLetters(table string, result *response) {
+	if Options.DeadLetterTable == "" || table == Options.DeadLetterTable {
+		return
+	} else if len(result.Errors) == 0 && len(result.Warnings) == 0 {
+		return
+	}
+
+	// resultはレスポンスで切り詰められるので先に行を作る
+	now := time.Now().Unix()
+	rows := make([]map[string]interface{}, 0, len(result.Errors)+len(result.Warnings))
+	for _, errs := range [][]*writeError{result.Errors, result.Warnings} {
+		for _, we := range errs {
+			payload := we.line
+			if payload == "" && we.Index >= 0 && we.Index < len(result.lines) {
+				payload = result.lines[we.Index]
+			}
+			rows = append(rows, map[string]interface{}{
+				"table":       table,
+				"error":       we.Error.Error(),
+				"payload":     payload,
+				"received_at": now,
+			})
+		}
+	}
+
+	h.async.Add(1)
+	go func() {
+		defer h.async.Done()
+		h.addDeadLetters(rows)
+	}()
+}
+
+func (h *httpHandler) addDeadLetters(rows []map[string]interface{}) {
+	project, dataset, dlTable, _ := splitTablePath(Options.DeadLetterTable)
+	writer, err := h.getBigqueryWriter("", project, dataset, dlTable)
+	if err != nil {
+		logger.Errorf("deadletter: %v", err)
+		return
+	}
+	defer writer.release()
+
+	for _, row := range rows {
+		// テーブルに設定されたinsertIdの方式を使う
+		insertId, err := tableInsertId(Options.DeadLetterTable, row)
+		if err == nil {
+			err = writer.Add(insertId, row)
+		}
+		if err != nil {
+			logger.Errorf("deadletter: %v", err)
+		}
+	}
+}
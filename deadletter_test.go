@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeadLettersAreWrittenInBackground(t *testing.T) {
+	writer := &fakeWriter{addErrs: []error{fmt.Errorf("invalid row")}}
+	dead := &fakeWriter{addBlock: make(chan struct{})}
+	defer func(f func(string, string, string) bigqueryWriter) { newWriter = f }(newWriter)
+	newWriter = func(project, dataset, table string) bigqueryWriter {
+		if table == "dead" {
+			return dead
+		}
+		return writer
+	}
+	defer func(s string) { Options.DeadLetterTable = s }(Options.DeadLetterTable)
+	Options.DeadLetterTable = "p/d/dead"
+
+	h := newHttpHandler()
+	h.setReady(true)
+	req := httptest.NewRequest("POST", "/p/d/t", strings.NewReader(`{"a": 1}`+"\n"))
+	w := httptest.NewRecorder()
+
+	// デッドレターの書き込みを待たずにレスポンスを返す
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+
+	close(dead.addBlock)
+	h.async.Wait()
+	if len(dead.rows) != 1 {
+		t.Fatalf("%d dead letters written, want 1", len(dead.rows))
+	}
+	row := dead.rows[0]
+	if row["table"] != "p/d/t" || row["error"] != "invalid row" || row["payload"] != `{"a": 1}` {
+		t.Errorf("dead letter = %v", row)
+	}
+	if _, ok := row["received_at"].(int64); !ok {
+		t.Errorf("received_at = %#v, want UNIX seconds", row["received_at"])
+	}
+}
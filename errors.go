@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The writer does not expose typed errors, so the errors from the BigQuery
+// API are classified by the reason and status code in their messages.
+// They are the errors that Add returns for a rejected insert request; see
+// bigqueryWriter.
+
+// isBackendError reports whether err is a temporary 503/backendError
+// returned by BigQuery, for example during maintenance.
+func isBackendError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "backendError") || strings.Contains(msg, "Error 503")
+}
+
+// isRateLimitError reports whether BigQuery throttled the insert by a rate
+// limit or a quota.
+func isRateLimitError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "rateLimitExceeded") || strings.Contains(msg, "quotaExceeded") ||
+		strings.Contains(msg, "Error 429")
+}
+
+// retryDelayPattern matches the retryDelay of a google.rpc.RetryInfo in the
+// details that googleapi.Error adds to its message.
+var retryDelayPattern = regexp.MustCompile(`"retryDelay":\s*"([0-9.]+s)"`)
+
+// retryDelay returns the delay that BigQuery suggested in a rate limit
+// error, or false when the error has none.
+func retryDelay(err error) (time.Duration, bool) {
+	m := retryDelayPattern.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0, false
+	}
+	d, perr := time.ParseDuration(m[1])
+	if perr != nil || d <= 0 {
+		return 0, false
+	}
+	return d, true
+}
+
+// isInsertIdError reports whether BigQuery rejected the insertId of a row.
+func isInsertIdError(err error) bool {
+	return strings.Contains(err.Error(), "insertId")
+}
+
+// isAuthError reports whether BigQuery rejected the credentials, for
+// example when the access token of a long-lived writer has expired.
+func isAuthError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "Error 401") || strings.Contains(msg, "authError") ||
+		strings.Contains(msg, "invalid_grant")
+}
+
+// isTimeout reports whether err is a timeout of the connection, such as
+// reading the request body over -read-timeout.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// googleapi.Errorは詳細をJSONでメッセージに付ける
+const rateLimitMessage = `googleapi: Error 429: Exceeded rate limits, rateLimitExceeded
+Details:
+[
+  {
+    "@type": "type.googleapis.com/google.rpc.RetryInfo",
+    "retryDelay": "2.5s"
+  }
+]`
+
+func TestRetryDelay(t *testing.T) {
+	if d, ok := retryDelay(fmt.Errorf("%s", rateLimitMessage)); !ok || d != 2500*time.Millisecond {
+		t.Errorf("retryDelay() = %v, %v, want 2.5s", d, ok)
+	}
+	if d, ok := retryDelay(fmt.Errorf("googleapi: Error 403: Quota exceeded, quotaExceeded")); ok {
+		t.Errorf("retryDelay() = %v, want none", d)
+	}
+}
+
+func TestThrottleRetryAfter(t *testing.T) {
+	defer func(d time.Duration) { Options.RateLimitRetry = d }(Options.RateLimitRetry)
+	Options.RateLimitRetry = 30 * time.Second
+
+	suggested := &response{rows: 2, Errors: []*writeError{
+		{Index: 0, Error: fmt.Errorf("%s", rateLimitMessage)},
+		{Index: 1, Error: fmt.Errorf("googleapi: Error 429: rateLimitExceeded")},
+	}}
+	if d := throttleRetryAfter(suggested); d != 3*time.Second {
+		t.Errorf("throttleRetryAfter() = %v, want 3s from BigQuery", d)
+	}
+
+	plain := &response{rows: 1, Errors: []*writeError{
+		{Index: 0, Error: fmt.Errorf("googleapi: Error 429: rateLimitExceeded")},
+	}}
+	if d := throttleRetryAfter(plain); d != 30*time.Second {
+		t.Errorf("throttleRetryAfter() = %v, want -rate-limit-retry-after", d)
+	}
+}
+
+func TestAddWithRetryWaitsSuggestedDelay(t *testing.T) {
+	defer func(d time.Duration) { Options.RateLimitRetry = d }(Options.RateLimitRetry)
+	Options.RateLimitRetry = 30 * time.Second
+
+	limited := fmt.Errorf(`googleapi: Error 429: rateLimitExceeded Details: [{"retryDelay": "0.05s"}]`)
+	writer := &fakeWriter{addErrs: []error{limited}}
+	start := time.Now()
+	if err := addWithRetry(writer, "id", map[string]interface{}{"a": 1}, 1); err != nil {
+		t.Fatalf("addWithRetry() = %v", err)
+	}
+	// 既定の1秒ではなく、示された待ち時間で再試行する
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed >= time.Second {
+		t.Errorf("retried after %v, want the suggested 50ms", elapsed)
+	}
+
+	// -rate-limit-retry-afterより長い待ち時間はクライアントに任せる
+	Options.RateLimitRetry = 10 * time.Millisecond
+	writer = &fakeWriter{addErrs: []error{limited}}
+	if err := addWithRetry(writer, "id", map[string]interface{}{"a": 1}, 1); err != limited {
+		t.Errorf("addWithRetry() = %v, want the rate limit error", err)
+	}
+}
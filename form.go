@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+)
+
+// isFormRequest reports whether the body is an HTML form with the rows in
+// the -form-field field.
+func isFormRequest(r *http.Request) bool {
+	if Options.FormField == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// formPayload returns the JSON lines or the JSON array in the form field.
+func formPayload(r *http.Request) ([]byte, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	values, ok := r.PostForm[Options.FormField]
+	if !ok || len(values) == 0 {
+		return nil, fmt.Errorf("form field %s is missing", Options.FormField)
+	}
+	return []byte(values[0]), nil
+}
@@ -1,133 +1,903 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/najeira/bigquery"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
-	"net/http"
+	"math"
 	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type httpHandler struct {
-	mu      sync.Mutex
-	writers map[string]*bigquery.Writer
+	mu       sync.Mutex
+	writers  map[string]*writerEntry
+	creating map[string]*writerCall
+	retiring sync.WaitGroup
+	ready    int32
+	draining int32
+	readonly int32
+	memStats memStatsCache
+	webhook  errorWebhook
+	metrics  metrics
+	api      *bigqueryAPI
+
+	// 処理中のリクエスト本文の合計バイト数と行数
+	bufferedBytes int64
+	queuedRows    int64
+
+	// ?async=1で受け付けた書き込み
+	async sync.WaitGroup
+
+	// drainでkeep-aliveを止めるため
+	server *http.Server
+
+	datasets     datasetCache
+	batches      asyncBatches
+	recentErrors recentErrors
+	canary       canaryCache
+}
+
+// bigqueryWriter is the part of bigquery.Writer used by the handler, so
+// that the tests can use a fake writer.
+//
+// Add returns the error of the insert request that BigQuery rejected, and
+// the breaker, the retries and the reconnection act on these errors. The
+// writer may hold a row it accepted until its next insert request, so a
+// nil error does not mean that the row reached BigQuery. The rows held at
+// the end are sent by Close.
+type bigqueryWriter interface {
+	rowWriter
+	Connect(email string, pem []byte) error
+	Close() error
+}
+
+// writerEntry is a cached writer with the requests currently using it.
+type writerEntry struct {
+	bigqueryWriter
+	h          *httpHandler
+	key        string
+	table      string
+	credential string
+	created    time.Time
+	users      sync.WaitGroup
+	breaker    breaker
+
+	// 実行中のAddの数と追加した行数
+	inFlight int64
+	rows     int64
+}
+
+// Add writes the row and records the result to the circuit breaker. When
+// the credentials of the writer have expired, the row is retried once with
+// a new writer.
+func (e *writerEntry) Add(insertId string, row map[string]interface{}) error {
+	atomic.AddInt64(&e.inFlight, 1)
+	err := e.bigqueryWriter.Add(insertId, row)
+	atomic.AddInt64(&e.inFlight, -1)
+	if err != nil && isAuthError(err) {
+		if next := e.replace(); next != nil {
+			defer next.release()
+			return next.Add(insertId, row)
+		}
+	}
+	if err != nil {
+		e.breaker.failure()
+		return err
+	}
+	atomic.AddInt64(&e.rows, 1)
+	e.breaker.success()
+	return nil
+}
+
+// 認証エラーで作り直したwriterを再び作り直すまでの間隔
+const reconnectInterval = time.Minute
+
+// replace retires the writer after an auth error and returns a new one
+// from getBigqueryWriter, which the caller must release. The writer is
+// shared by the requests for the table, so it is not connected again while
+// they may be adding rows to it. A writer younger than reconnectInterval
+// is not replaced, so that invalid credentials do not reconnect per row.
+func (e *writerEntry) replace() *writerEntry {
+	if e.h == nil || time.Since(e.created) < reconnectInterval {
+		return nil
+	}
+	project, dataset, table, err := splitTablePath(e.table)
+	if err != nil {
+		return nil
+	}
+
+	// 他のリクエストが入れ替えた後なら新しいwriterを使う
+	e.h.mu.Lock()
+	if e.h.writers[e.key] == e {
+		delete(e.h.writers, e.key)
+		logger.Warnf("writer %s failed to authenticate, reconnect", e.key)
+		e.h.retireWriter(e.key, e)
+	}
+	e.h.mu.Unlock()
+
+	next, err := e.h.getBigqueryWriter(e.credential, project, dataset, table)
+	if err != nil {
+		logger.Errorf("reconnect %s: %v", e.table, err)
+		return nil
+	}
+	return next
+}
+
+// release must be called when the request finished using the writer.
+func (e *writerEntry) release() {
+	e.users.Done()
 }
 
 func newHttpHandler() *httpHandler {
-	rand.Seed(time.Now().Nanosecond())
+	rand.Seed(int64(time.Now().Nanosecond()))
 	return &httpHandler{
-		writers: make(map[string]*bigquery.Writer),
+		writers:  make(map[string]*writerEntry),
+		creating: make(map[string]*writerCall),
 	}
 }
 
-func (h *httpHandler) Close() {
-	for _, writer := range h.writers {
-		writer.Close()
+func (h *httpHandler) setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
 	}
+	atomic.StoreInt32(&h.ready, v)
+}
+
+func (h *httpHandler) isReady() bool {
+	return atomic.LoadInt32(&h.ready) != 0
 }
 
-func (h *httpHandler) getBigqueryWriter(project, database, table string) (*bigquery.Writer, error) {
-	key := fmt.Sprintf("%s|%s|%s", project, database, table)
+var (
+	errTooManyBufferedBytes = fmt.Errorf("too many buffered bytes")
+	errTooManyQueuedRows    = fmt.Errorf("too many queued rows")
+)
+
+// reserveBuffer adds n to the bytes held by the requests in progress.
+// It fails if the total would exceed -max-buffer-bytes. The rows held
+// inside the writers are not visible to the proxy and can not be flushed
+// from here, so only the request bodies are counted and new bodies are
+// rejected with 429 over the ceiling.
+func (h *httpHandler) reserveBuffer(n int64) bool {
+	total := atomic.AddInt64(&h.bufferedBytes, n)
+	if Options.MaxBufferBytes > 0 && total > Options.MaxBufferBytes {
+		atomic.AddInt64(&h.bufferedBytes, -n)
+		return false
+	}
+	return true
+}
+
+func (h *httpHandler) releaseBuffer(n int64) {
+	atomic.AddInt64(&h.bufferedBytes, -n)
+}
+
+// reserveRows adds n to the rows of the requests in progress. It fails if
+// the total would exceed -max-queued-rows.
+func (h *httpHandler) reserveRows(n int64) bool {
+	total := atomic.AddInt64(&h.queuedRows, n)
+	if Options.MaxQueuedRows > 0 && total > Options.MaxQueuedRows {
+		atomic.AddInt64(&h.queuedRows, -n)
+		return false
+	}
+	return true
+}
+
+func (h *httpHandler) releaseRows(n int64) {
+	atomic.AddInt64(&h.queuedRows, -n)
+}
+
+// releaseBody releases the bytes and the rows reserved for the body.
+func (h *httpHandler) releaseBody(body *requestBody) {
+	h.releaseBuffer(body.reservedBytes)
+	h.releaseRows(body.reservedRows)
+	body.reservedBytes, body.reservedRows = 0, 0
+}
+
+func (h *httpHandler) setDraining(draining bool) {
+	var v int32
+	if draining {
+		v = 1
+	}
+	atomic.StoreInt32(&h.draining, v)
+}
+
+func (h *httpHandler) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) != 0
+}
+
+func (h *httpHandler) setReadOnly(readonly bool) {
+	var v int32
+	if readonly {
+		v = 1
+	}
+	atomic.StoreInt32(&h.readonly, v)
+}
+
+func (h *httpHandler) isReadOnly() bool {
+	return atomic.LoadInt32(&h.readonly) != 0
+}
+
+// 終了時に同時にCloseするwriterの数
+const closeConcurrency = 8
+
+// Close flushes and closes all writers. With -shutdown-mode=fast it
+// returns without flushing, and the rows buffered in the writers are lost.
+//
+// A writer whose Close failed is not closed again. bigquery.Writer does not
+// document that Close may be called twice, and a second call after a failed
+// flush could send the rows again, drop them or panic, so the error is only
+// logged and reported.
+func (h *httpHandler) Close() error {
+	h.setReady(false)
+
+	if Options.ShutdownMode == "fast" {
+		h.mu.Lock()
+		n := len(h.writers)
+		h.mu.Unlock()
+		logger.Warnf("fast shutdown, %d writers are not flushed", n)
+		return nil
+	}
+
+	// 非同期の書き込みがwriterを作らなくなるまで待つ
+	h.async.Wait()
+
+	h.mu.Lock()
+	writers := h.writers
+	h.writers = make(map[string]*writerEntry)
+	h.mu.Unlock()
+
+	// 期限切れで入れ替えたwriterのCloseを待つ
+	h.retiring.Wait()
+
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	errs := make([]error, 0)
+	sem := make(chan struct{}, closeConcurrency)
+	for key, writer := range writers {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string, writer *writerEntry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			writer.users.Wait()
+			h.metrics.writerClosed()
+			if err := writer.Close(); err != nil {
+				logger.Errorf("close %s: %v", key, err)
+				errMu.Lock()
+				errs = append(errs, err)
+				errMu.Unlock()
+			}
+		}(key, writer)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d writers failed to close", len(errs), len(writers))
+	}
+	return nil
+}
+
+// getBigqueryWriter returns the writer for the table connected with the
+// named credential, or the default one for "". The caller must call
+// release on the returned entry when it is done with it.
+//
+// Connecting a writer takes time, so it is done without the lock. Only the
+// first request for a new table creates the writer, and the concurrent
+// requests for the same table wait for it.
+func (h *httpHandler) getBigqueryWriter(credential, project, database, table string) (*writerEntry, error) {
+	key := fmt.Sprintf("%s|%s|%s|%s", credential, project, database, table)
 
 	h.mu.Lock()
-	defer h.mu.Unlock()
+	for {
+		entry, ok := h.writers[key]
+		if ok {
+			if Options.WriterMaxAge <= 0 || time.Since(entry.created) < Options.WriterMaxAge {
+				entry.users.Add(1)
+				h.mu.Unlock()
+				return entry, nil
+			}
+			delete(h.writers, key)
+			logger.Infof("writer %s is older than %v, reconnect", key, Options.WriterMaxAge)
+			h.retireWriter(key, entry)
+		}
+
+		call, ok := h.creating[key]
+		if !ok {
+			break
+		}
+
+		// 他のリクエストが作成中のwriterを待つ
+		h.mu.Unlock()
+		<-call.done
+		if call.err != nil {
+			return nil, call.err
+		}
+		h.mu.Lock()
+	}
 
-	writer, ok := h.writers[key]
-	if ok {
-		return writer, nil
+	// テーブル名の生成ミスなどによる際限のない増加を防ぐ
+	if n := len(h.writers) + len(h.creating); Options.MaxTables > 0 && n >= Options.MaxTables {
+		h.mu.Unlock()
+		logger.Errorf("too many tables: %d writers, rejected %s", n, key)
+		return nil, errTooManyTables
 	}
 
-	writer, err := h.newBigqueryWriter(project, database, table)
+	call := &writerCall{done: make(chan struct{})}
+	h.creating[key] = call
+	h.mu.Unlock()
+
+	writer, err := h.newBigqueryWriter(credential, project, database, table)
+
+	h.mu.Lock()
+	delete(h.creating, key)
 	if err != nil {
+		h.mu.Unlock()
+		call.err = err
+		close(call.done)
 		return nil, err
 	}
 
-	h.writers[key] = writer
-	return writer, nil
+	entry := &writerEntry{
+		bigqueryWriter: writer,
+		h:              h,
+		key:            key,
+		table:          project + "/" + database + "/" + table,
+		credential:     credential,
+		created:        time.Now(),
+	}
+	entry.users.Add(1)
+	h.writers[key] = entry
+	h.mu.Unlock()
+	close(call.done)
+
+	h.metrics.writerCreated()
+	return entry, nil
 }
 
-func (h *httpHandler) newBigqueryWriter(project, database, table string) (*bigquery.Writer, error) {
-	writer := bigquery.NewWriter(project, database, table)
-	if err := writer.Connect(Options.Email, Options.Pem); err != nil {
+// writerCall is a writer being created by getBigqueryWriter.
+type writerCall struct {
+	done chan struct{}
+	err  error
+}
+
+// retireWriter closes the writer after all requests using it have finished,
+// so rows added by those requests are flushed before the writer goes away.
+func (h *httpHandler) retireWriter(key string, entry *writerEntry) {
+	h.retiring.Add(1)
+	go func() {
+		defer h.retiring.Done()
+		entry.users.Wait()
+		h.metrics.writerClosed()
+		if err := entry.Close(); err != nil {
+			logger.Errorf("close %s: %v", key, err)
+		}
+	}()
+}
+
+var errTooManyTables = fmt.Errorf("too many tables")
+
+// Connectをリトライする際の初回の待ち時間
+var connectRetryInterval = time.Millisecond * 500
+
+func (h *httpHandler) newBigqueryWriter(credential, project, database, table string) (bigqueryWriter, error) {
+	email, pem, err := credentialFor(credential)
+	if err != nil {
+		return nil, err
+	}
+	if Options.CheckDataset && h.api != nil {
+		if err := h.datasets.checkDataset(h.api, project, database); err != nil {
+			return nil, err
+		}
+	}
+	writer := newWriter(project, database, table)
+	if err := connectWithRetry(writer, email, pem, Options.ConnectRetries); err != nil {
 		return nil, err
 	}
-	writer.SetLogger(logger)
 	return writer, nil
 }
 
-func (h *httpHandler) internalError(w http.ResponseWriter, msg string) {
-	logger.Infof(msg)
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Write([]byte(`{"error": "` + msg + `"}`))
+// newWriter creates the writer of a table before it is connected. The
+// tests replace it to use a fake writer.
+var newWriter = func(project, dataset, table string) bigqueryWriter {
+	writer := bigquery.NewWriter(project, dataset, table)
+	writer.SetLogger(logger)
+	return writer
+}
+
+func connectWithRetry(writer bigqueryWriter, email string, pem []byte, retries int) error {
+	interval := connectRetryInterval
+	for i := 0; ; i++ {
+		err := writer.Connect(email, pem)
+		if err == nil {
+			return nil
+		} else if i >= retries || !isTransientError(err) {
+			return err
+		}
+		logger.Warnf("connect failed, retry in %v: %v", interval, err)
+		time.Sleep(interval)
+		interval *= 2
+	}
 }
 
-func (h *httpHandler) badRequest(w http.ResponseWriter, msg string) {
-	logger.Infof(msg)
-	w.WriteHeader(http.StatusBadRequest)
+// isTransientError reports whether err is a network error that may succeed
+// on retry. Authentication errors are not transient.
+func isTransientError(err error) bool {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	if oerr, ok := err.(*net.OpError); ok {
+		if _, ok := oerr.Err.(*net.DNSError); !ok {
+			// 接続の拒否やリセットなど
+			return true
+		}
+		err = oerr.Err
+	}
+	switch e := err.(type) {
+	case *net.DNSError:
+		return e.IsTemporary || e.IsTimeout
+	case net.Error:
+		return e.Timeout()
+	}
+	return false
+}
+
+// errorResponse writes msg as JSON, or as plain text when the client
+// prefers text/plain in its Accept header.
+func (h *httpHandler) errorResponse(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	h.errorResponseCode(w, r, status, "", msg)
+}
+
+// errorResponseCode is errorResponse with a machine readable code, which
+// is added to the JSON as "code" so that clients can tell the errors apart.
+func (h *httpHandler) errorResponseCode(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	logger.Infof("%s", msg)
+	if prefersPlainText(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		w.Write([]byte(msg + "\n"))
+		return
+	}
+	resp := map[string]string{"error": msg}
+	if code != "" {
+		resp["code"] = code
+	}
+	body, _ := json.Marshal(resp)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Write([]byte(`{"error": "` + msg + `"}`))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (h *httpHandler) internalError(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusInternalServerError, msg)
+}
+
+func (h *httpHandler) badRequest(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusBadRequest, msg)
+}
+
+func (h *httpHandler) requestTimeout(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusRequestTimeout, msg)
+}
+
+func (h *httpHandler) requestEntityTooLarge(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusRequestEntityTooLarge, msg)
+}
+
+func (h *httpHandler) tooManyRequests(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusTooManyRequests, msg)
+}
+
+func (h *httpHandler) unsupportedMediaType(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusUnsupportedMediaType, msg)
+}
+
+func (h *httpHandler) unauthorized(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusUnauthorized, msg)
+}
+
+func (h *httpHandler) forbidden(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusForbidden, msg)
+}
+
+func (h *httpHandler) notFound(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusNotFound, msg)
+}
+
+func (h *httpHandler) methodNotAllowed(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusMethodNotAllowed, msg)
+}
+
+func (h *httpHandler) serviceUnavailable(w http.ResponseWriter, r *http.Request, msg string) {
+	h.errorResponse(w, r, http.StatusServiceUnavailable, msg)
 }
 
 func (h *httpHandler) ok(w http.ResponseWriter, msg []byte) {
 	logger.Debugf(string(msg))
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
 	w.Write(msg)
 }
 
-func (h *httpHandler) serveStatus(w http.ResponseWriter) {
+// serveRoot serves "/" by -root-mode.
+func (h *httpHandler) serveRoot(w http.ResponseWriter, r *http.Request) {
+	switch Options.RootMode {
+	case "health":
+		h.ok(w, []byte(`{"status": "ok"}`))
+	case "redirect":
+		http.Redirect(w, r, Options.RootRedirect, http.StatusFound)
+	default:
+		// top is status dashboard.
+		h.serveStatus(w, r)
+	}
 }
 
-func (h *httpHandler) sendLines(writer *bigquery.Writer, lines []string) []*writeError {
-	var row map[string]interface{}
-	errors := make([]*writeError, 0)
-	for i, line := range lines {
-		if err := json.Unmarshal([]byte(line), &row); err != nil {
-			errors = append(errors, &writeError{Index: i, Error: err})
-			continue
+func (h *httpHandler) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("deep") == "1" {
+		if err := h.canary.get(h.checkCanary); err != nil {
+			h.serviceUnavailable(w, r, err.Error())
+			return
 		}
-		if err := writer.Add(generateInsertId(10), row); err != nil {
-			errors = append(errors, &writeError{Index: i, Error: err})
-			continue
+	}
+	h.ok(w, []byte(`{"status": "ok"}`))
+}
+
+// canaryCache keeps the result of the last canary insert for
+// -canary-interval. /healthz is not authenticated, so each probe must not
+// make a billable insert.
+type canaryCache struct {
+	mu      sync.Mutex
+	err     error
+	checked time.Time
+}
+
+// get returns the cached result, or runs check when it is older than
+// -canary-interval. Concurrent probes wait for the same check.
+func (c *canaryCache) get(check func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checked.IsZero() || time.Since(c.checked) >= Options.CanaryInterval {
+		c.err = check()
+		c.checked = time.Now()
+	}
+	return c.err
+}
+
+// checkCanary inserts a tiny row to the canary table with the insertAll
+// API to verify that the credentials and quota still allow writes. The
+// row is {"checked_at": <UNIX seconds>}, so the table needs a checked_at
+// INTEGER column. The API is called directly instead of a writer. A
+// writer may hold the row without sending it, and then Add returns nil
+// even when inserts are failing.
+func (h *httpHandler) checkCanary() error {
+	if Options.CanaryTable == "" {
+		return fmt.Errorf("canary table is not configured")
+	}
+	project, dataset, table, _ := splitTablePath(Options.CanaryTable)
+	path := "/projects/" + url.PathEscape(project) + "/datasets/" + url.PathEscape(dataset) +
+		"/tables/" + url.PathEscape(table) + "/insertAll"
+	row := map[string]interface{}{"checked_at": time.Now().Unix()}
+	insertId, err := tableInsertId(Options.CanaryTable, row)
+	if err != nil {
+		return err
+	}
+	req := map[string]interface{}{
+		"rows": []map[string]interface{}{{"insertId": insertId, "json": row}},
+	}
+	var resp struct {
+		InsertErrors []struct {
+			Errors []struct {
+				Message string `json:"message"`
+			} `json:"errors"`
+		} `json:"insertErrors"`
+	}
+	if err := h.api.call("POST", path, req, &resp); err != nil {
+		return err
+	}
+	if len(resp.InsertErrors) > 0 {
+		msg := "unknown error"
+		if errs := resp.InsertErrors[0].Errors; len(errs) > 0 {
+			msg = errs[0].Message
 		}
+		return fmt.Errorf("canary insert failed: %s", msg)
 	}
-	return errors
+	return nil
+}
+
+func (h *httpHandler) serveReady(w http.ResponseWriter, r *http.Request) {
+	if !h.isReady() {
+		h.serviceUnavailable(w, r, "not ready")
+		return
+	}
+	h.ok(w, []byte(`{"ready": true}`))
+}
+
+// insertOptions holds the per-request options of an insert request.
+type insertOptions struct {
+	start    time.Time
+	table    string
+	insertId string
+	keyField string
+	pretty   bool
+	maxRows  int
+	retries  int
+	sample   bool
+	route    bool
+	minimal  bool
+	async    bool
+	stream   *progressStream
+
+	// X-Credentialで選ばれた認証情報
+	credential string
+
+	// エラーをメッセージごとにまとめて返す
+	aggregate bool
+
+	// -slo-deadlineを過ぎたら503を返す
+	slo bool
+
+	// JSON配列の要素ごとの予約
+	reservation *arrayReservation
 }
 
-func (h *httpHandler) serveBigquery(w http.ResponseWriter, project, dataset, table string, body []byte) {
-	writer, err := h.getBigqueryWriter(project, dataset, table)
+func (h *httpHandler) serveBigquery(w http.ResponseWriter, r *http.Request, project, dataset, table string, opts *insertOptions, body *requestBody) {
+	var result *response
+	var err error
+
+	defer func() {
+		rows := 0
+		if result != nil {
+			rows = result.rows
+		}
+		logSlowRequest(r, opts.start, rows)
+		statsdRequest(opts.start, result)
+	}()
+
+	// 書き込み処理のspan
+	if tracer != nil {
+		_, span := tracer.Start(r.Context(), "write")
+		defer func() {
+			span.End()
+			if result != nil {
+				setResultAttributes(trace.SpanFromContext(r.Context()), result)
+			}
+		}()
+	}
+
+	if opts.async {
+		h.serveAsync(w, r, project, dataset, table, opts, body)
+		return
+	}
+
+	if opts.route && body.array != nil {
+		h.badRequest(w, r, errArrayRoute.Error())
+		return
+	}
+
+	// 期限の後も書き込みを続けるので、本文を先に読んでおく
+	if opts.slo && body.array != nil {
+		if body, err = body.buffer(); isTimeout(err) {
+			h.requestTimeout(w, r, "timeout reading request body")
+			return
+		} else if err != nil {
+			h.badRequest(w, r, err.Error())
+			return
+		}
+		if !h.reserveBuffer(int64(len(body.data))) {
+			h.tooManyRequests(w, r, errTooManyBufferedBytes.Error())
+			return
+		}
+		body.reservedBytes = int64(len(body.data))
+		defer h.releaseBody(body)
+		opts.reservation = &arrayReservation{h: h, rowsOnly: true}
+	} else if body.array != nil {
+		opts.reservation = &arrayReservation{h: h}
+	}
+
+	var process func() (*response, error)
+	if opts.route {
+		process = func() (*response, error) {
+			return h.processRoutedBatch(project, dataset, table, body.data, opts)
+		}
+	} else {
+		writer, werr := h.getBigqueryWriter(opts.credential, project, dataset, table)
+		if werr == errTooManyTables {
+			h.serviceUnavailable(w, r, werr.Error())
+			return
+		} else if werr == errDatasetNotFound {
+			h.badRequest(w, r, werr.Error())
+			return
+		} else if werr != nil {
+			h.internalError(w, r, werr.Error())
+			return
+		}
+
+		if !writer.breaker.allow() {
+			writer.release()
+			h.serviceUnavailable(w, r, errBreakerOpen.Error())
+			return
+		}
+
+		process = func() (*response, error) {
+			defer writer.release()
+			if body.array != nil {
+				return ProcessArray(writer, body.array, opts)
+			}
+			return ProcessBatch(writer, body.data, opts)
+		}
+	}
+
+	if opts.slo {
+		// 期限の後も書き込みが続くので、本文の予約は書き込みの完了まで持つ
+		var ok bool
+		if result, err, ok = h.processWithDeadline(opts.table, body.take(), process); !ok {
+			h.serviceUnavailable(w, r, "slo deadline exceeded")
+			return
+		}
+	} else {
+		result, err = process()
+	}
+
 	if err != nil {
-		h.internalError(w, err.Error())
+		h.batchError(w, r, opts, err)
+		return
+	}
+
+	// JSON配列は書き込むまで行数が分からない
+	if body.array != nil {
+		addConnRows(w, r, result.rows)
+	}
+
+	h.webhook.notify(opts.table, result)
+	h.writeDeadLetters(opts.table, result)
+	h.recentErrors.add(opts.table, result.Errors)
+
+	// ?errors=aggregate groups the errors by message
+	var out interface{} = result
+	if opts.aggregate {
+		out = aggregateErrors(result)
+	}
+	result.truncateErrors(Options.MaxErrors)
+
+	// 全行がBigQueryに制限された場合はクライアントに待ってもらう
+	if opts.stream == nil && isThrottled(result) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(throttleRetryAfter(result)/time.Second)))
+		h.tooManyRequests(w, r, "rate limited by bigquery")
+		return
+	}
+
+	// ?format=minimal returns {"ok": true} instead of {"errors": []}
+	// when all rows succeeded. Otherwise the response is the same.
+	if opts.minimal && len(result.Errors) == 0 {
+		if opts.stream != nil {
+			opts.stream.write(minimalResponse)
+		} else {
+			h.ok(w, []byte(`{"ok": true}`))
+		}
 		return
 	}
 
-	lines := strings.Split(string(body), "\n")
-	errors := h.sendLines(writer, lines)
+	if opts.stream != nil {
+		opts.stream.write(out)
+		return
+	}
 
-	resp, err := json.Marshal(&response{Errors: errors})
+	resp, err := marshalResponse(out, opts.pretty)
 	if err != nil {
-		h.internalError(w, err.Error())
+		h.internalError(w, r, err.Error())
 		return
 	}
 
 	h.ok(w, resp)
 }
 
+// batchError writes the response for an error of a whole batch.
+func (h *httpHandler) batchError(w http.ResponseWriter, r *http.Request, opts *insertOptions, err error) {
+	if err == errTooManyRows {
+		h.requestEntityTooLarge(w, r, fmt.Sprintf("too many rows, max %d", opts.maxRows))
+	} else if err == errTooManyBufferedBytes || err == errTooManyQueuedRows {
+		h.tooManyRequests(w, r, err.Error())
+	} else if err == errInsertIdMultipleRows || err == errBodyNotJSON {
+		h.badRequest(w, r, err.Error())
+	} else {
+		h.internalError(w, r, err.Error())
+	}
+}
+
 func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// 異常に長いパスは分割やキーの生成の前に拒否する
+	if Options.MaxPathLength > 0 && len(r.URL.Path) > Options.MaxPathLength {
+		h.errorResponse(w, r, http.StatusRequestURITooLong, "uri too long")
+		return
+	}
+
+	// 監視ツールはHEADで確認することもある
+	// HEADのレスポンスの本文はnet/httpが捨てるので、ヘッダだけが返る
+	switch r.URL.Path {
+	case "/", "/healthz", "/livez", "/readyz":
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			h.methodNotAllowed(w, r, "method not allowed")
+			return
+		}
+	}
+
 	if r.URL.Path == "/" {
-		// top is status dashboard.
-		h.serveStatus(w)
+		h.serveRoot(w, r)
+		return
+	} else if r.URL.Path == "/healthz" {
+		h.serveHealth(w, r)
+		return
+	} else if r.URL.Path == "/metrics" {
+		h.serveMetrics(w, r)
+		return
+	} else if r.URL.Path == "/livez" {
+		h.ok(w, []byte(`{"status": "ok"}`))
+		return
+	} else if r.URL.Path == "/readyz" {
+		h.serveReady(w, r)
+		return
+	} else if strings.HasPrefix(r.URL.Path, "/admin/") {
+		h.serveAdmin(w, r)
+		return
+	} else if strings.HasPrefix(r.URL.Path, "/status/") {
+		h.serveBatchStatus(w, r)
+		return
+	}
+
+	// 起動処理の完了前やシャットダウン中は書き込みを受け付けない
+	if !h.isReady() {
+		h.serviceUnavailable(w, r, "not ready")
+		return
+	} else if h.isDraining() {
+		h.serviceUnavailable(w, r, "draining")
+		return
+	} else if h.isReadOnly() {
+		// メンテナンス中もヘルスチェックは成功させる
+		h.serviceUnavailable(w, r, "read-only for maintenance")
+		return
+	}
+
+	// 過負荷のときは優先度の低いリクエストから断る
+	priority, err := requestPriority(r)
+	if err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	} else if shouldShed(priority) {
+		h.metrics.requestShed()
+		h.serviceUnavailable(w, r, "overloaded")
+		return
+	}
+
+	start := time.Now()
+
+	if strings.HasPrefix(r.URL.Path, "/load/") {
+		h.serveLoad(w, r)
+		return
+	} else if strings.HasPrefix(r.URL.Path, "/schema/") {
+		h.serveSchema(w, r)
 		return
 	}
 
 	params := strings.Split(r.URL.Path, "/")
 	if len(params) != 4 {
-		h.badRequest(w, "invalid uri")
+		h.errorResponseCode(w, r, http.StatusBadRequest, "invalid_segments",
+			fmt.Sprintf("uri must be /project/dataset/table, got %d segments", len(params)-1))
 		return
 	}
 
@@ -135,29 +905,450 @@ func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	dataset := params[2]
 	table := params[3]
 
-	if project == "" || dataset == "" || table == "" {
-		h.badRequest(w, "invalid uri")
+	if project == "" {
+		h.errorResponseCode(w, r, http.StatusBadRequest, "missing_project", "project is empty")
+		return
+	} else if dataset == "" {
+		h.errorResponseCode(w, r, http.StatusBadRequest, "missing_dataset", "dataset is empty")
+		return
+	} else if table == "" {
+		h.errorResponseCode(w, r, http.StatusBadRequest, "missing_table", "table is empty")
+		return
+	} else if err := checkName("project", project); err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	} else if err := checkName("dataset", dataset); err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	} else if err := checkName("table", table); err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	} else if err := checkPartitionDecorator(table); err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	}
+
+	if tracer != nil {
+		ctx, span := startRequestSpan(r.Context(), project, dataset, table)
+		defer span.End()
+		r = r.WithContext(ctx)
+	}
+
+	// 本文を読まずに使えるメソッドを返す
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Allow", "POST, PUT, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch authorizeProject(r, project) {
+	case http.StatusUnauthorized:
+		h.unauthorized(w, r, "unauthorized")
+		return
+	case http.StatusForbidden:
+		h.forbidden(w, r, "project is not allowed")
+		return
+	}
+
+	if !isDatasetAllowed(dataset) {
+		h.forbidden(w, r, errDatasetNotAllowed.Error())
+		return
+	}
+
+	form := isFormRequest(r)
+	if Options.RequireContentType && !form && !isSupportedContentType(r.Header.Get("Content-Type")) {
+		h.unsupportedMediaType(w, r, "unsupported content type")
 		return
 	}
 
 	// read body
-	body, err := ioutil.ReadAll(r.Body)
-	r.Body.Close()
+	// JSON配列は読みながら書き込むので、ここでは読まない
+	defer r.Body.Close()
+	body := &requestBody{}
+	if form {
+		// HTMLのフォームから送られた行
+		data, err := formPayload(r)
+		if isTimeout(err) {
+			h.requestTimeout(w, r, "timeout reading request body")
+			return
+		} else if err != nil {
+			h.badRequest(w, r, err.Error())
+			return
+		}
+		body.data = data
+		if isJSONArrayBytes(data) {
+			body.array = bytes.NewReader(data)
+		}
+	} else {
+		br := bufio.NewReader(r.Body)
+		skipBOM(br)
+		if isJSONArray(br) {
+			body.array = br
+		} else {
+			data, err := ioutil.ReadAll(br)
+			if isTimeout(err) {
+				// 本文の送信が遅いクライアント
+				h.requestTimeout(w, r, "timeout reading request body")
+				return
+			} else if err != nil {
+				h.badRequest(w, r, err.Error())
+				return
+			}
+			body.data = data
+		}
+	}
+
+	if body.array == nil {
+		data := body.data
+
+		// 全リクエストで保持している本文が多すぎる場合は受け付けない
+		if !h.reserveBuffer(int64(len(data))) {
+			h.tooManyRequests(w, r, errTooManyBufferedBytes.Error())
+			return
+		}
+		body.reservedBytes = int64(len(data))
+		defer h.releaseBody(body)
+
+		rows := int64(countBodyRows(data))
+		addConnRows(w, r, int(rows))
+		if !h.reserveRows(rows) {
+			h.tooManyRequests(w, r, errTooManyQueuedRows.Error())
+			return
+		}
+		body.reservedRows = rows
+	}
+
+	maxRows, err := requestMaxRows(r)
+	if err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	}
+
+	retries, err := requestRetries(r)
 	if err != nil {
-		h.badRequest(w, err.Error())
+		h.badRequest(w, r, err.Error())
 		return
 	}
 
-	h.serveBigquery(w, project, dataset, table, body)
+	opts := &insertOptions{
+		start:   start,
+		table:   project + "/" + dataset + "/" + table,
+		pretty:  r.URL.Query().Get("pretty") == "1",
+		maxRows: maxRows,
+		retries: retries,
+		route:   r.URL.Query().Get("route") == "1",
+		minimal: r.URL.Query().Get("format") == "minimal",
+		async:   r.URL.Query().Get("async") == "1",
+
+		aggregate: r.URL.Query().Get("errors") == "aggregate",
+	}
+
+	if isStreamRequest(r) {
+		opts.stream = newProgressStream(w, Options.StreamChunkRows)
+	}
+
+	// 途中経過を書き始めた後は503を返せない
+	opts.slo = opts.stream == nil && isSLORequest(r)
+
+	// 1行だけのリクエストはヘッダでinsertIdを指定できる
+	opts.insertId = r.Header.Get("X-Insert-Id")
+
+	// 書き込みに使う認証情報を選ぶ
+	opts.credential = r.Header.Get("X-Credential")
+	if _, _, err := credentialFor(opts.credential); err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	}
+	switch authorizeCredential(r, opts.credential) {
+	case http.StatusUnauthorized:
+		h.unauthorized(w, r, "unauthorized")
+		return
+	case http.StatusForbidden:
+		h.forbidden(w, r, "credential is not allowed")
+		return
+	}
+
+	// サンプリングは明示的に指定されたテーブルのみ
+	opts.sample = Options.SampleRate > 0 && opts.table == Options.SampleTable
+
+	// PUTの場合は行のキーをinsertIdとして使う
+	if r.Method == "PUT" {
+		opts.keyField = Options.KeyField
+	}
+
+	h.serveBigquery(w, r, project, dataset, table, opts, body)
 }
 
 type writeError struct {
-	Index int   `json:index`
-	Error error `json:error`
+	Index int   `json:"index"`
+	Error error `json:"error"`
+
+	// 元の行。JSON配列では行を保持しないのでエラーの行だけ持つ
+	line string
+}
+
+// MarshalJSON writes the message of the error, since an error value
+// itself has no exported fields to marshal.
+func (e *writeError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Index int    `json:"index"`
+		Error string `json:"error"`
+	}{e.Index, e.Error.Error()})
 }
 
 type response struct {
-	Errors []*writeError `json:errors`
+	Errors   []*writeError `json:"errors"`
+	Warnings []*writeError `json:"warnings,omitempty"`
+
+	// -max-errorsで切り詰めた場合のエラーの総数
+	Truncated   bool `json:"truncated,omitempty"`
+	TotalErrors int  `json:"total_errors,omitempty"`
+
+	// リクエストに含まれていた行数と元の行
+	rows  int
+	lines []string
+}
+
+// errorGroup is the errors of a batch with the same message.
+type errorGroup struct {
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+	Indexes []int  `json:"indexes"`
+}
+
+type aggregatedResponse struct {
+	Errors   []*errorGroup `json:"errors"`
+	Warnings []*writeError `json:"warnings,omitempty"`
+}
+
+// 各グループで返す行番号の数
+const errorGroupIndexes = 5
+
+// aggregateErrors groups the errors of the response by message, with the
+// first indexes of each group. The groups are in the order of their first
+// error.
+func aggregateErrors(resp *response) *aggregatedResponse {
+	groups := make([]*errorGroup, 0)
+	byMessage := make(map[string]*errorGroup)
+	for _, we := range resp.Errors {
+		msg := we.Error.Error()
+		group, ok := byMessage[msg]
+		if !ok {
+			group = &errorGroup{Message: msg, Indexes: make([]int, 0, 1)}
+			byMessage[msg] = group
+			groups = append(groups, group)
+		}
+		group.Count++
+		if len(group.Indexes) < errorGroupIndexes {
+			group.Indexes = append(group.Indexes, we.Index)
+		}
+	}
+	return &aggregatedResponse{Errors: groups, Warnings: resp.Warnings}
+}
+
+// isThrottled reports whether every row of the request failed with a rate
+// limit error of BigQuery.
+func isThrottled(resp *response) bool {
+	if resp.rows == 0 || resp.errorCount() != resp.rows {
+		return false
+	}
+	for _, we := range resp.Errors {
+		if !isRateLimitError(we.Error) {
+			return false
+		}
+	}
+	return true
+}
+
+// throttleRetryAfter returns the Retry-After of a throttled response: the
+// longest delay suggested by BigQuery, rounded up to seconds, or
+// -rate-limit-retry-after when BigQuery suggested none.
+func throttleRetryAfter(resp *response) time.Duration {
+	var after time.Duration
+	for _, we := range resp.Errors {
+		if d, ok := retryDelay(we.Error); ok && d > after {
+			after = d
+		}
+	}
+	if after == 0 {
+		return Options.RateLimitRetry
+	}
+	return (after + time.Second - 1).Truncate(time.Second)
+}
+
+// errorCount returns the number of errors before truncation.
+func (resp *response) errorCount() int {
+	if resp.Truncated {
+		return resp.TotalErrors
+	}
+	return len(resp.Errors)
+}
+
+// truncateErrors keeps the first max errors in the response, so that a
+// batch where every row failed does not return a response as large as
+// the request. All rows have been processed already.
+func (resp *response) truncateErrors(max int) {
+	if max <= 0 || len(resp.Errors) <= max {
+		return
+	}
+	resp.TotalErrors = len(resp.Errors)
+	resp.Truncated = true
+	resp.Errors = resp.Errors[:max]
+}
+
+var minimalResponse = map[string]bool{"ok": true}
+
+// logSlowRequest logs an insert request slower than -slow-threshold.
+func logSlowRequest(r *http.Request, start time.Time, rows int) {
+	if Options.SlowThreshold <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed > Options.SlowThreshold {
+		logger.Warnf("slow request %s %d rows %v", r.URL.Path, rows, elapsed)
+	}
+}
+
+func sortWriteErrors(errors []*writeError) {
+	sort.Slice(errors, func(i, j int) bool {
+		return errors[i].Index < errors[j].Index
+	})
+}
+
+func marshalResponse(resp interface{}, pretty bool) ([]byte, error) {
+	if pretty {
+		return json.MarshalIndent(resp, "", "  ")
+	}
+	return json.Marshal(resp)
+}
+
+// requestMaxRows returns the row limit for the request. The X-Max-Rows header
+// can lower the global -max-rows but never raise it.
+func requestMaxRows(r *http.Request) (int, error) {
+	maxRows := Options.MaxRows
+	value := r.Header.Get("X-Max-Rows")
+	if value == "" {
+		return maxRows, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid X-Max-Rows %s", value)
+	}
+	if maxRows <= 0 || n < maxRows {
+		maxRows = n
+	}
+	return maxRows, nil
+}
+
+// X-Max-Retriesで指定できる再試行回数の上限
+const maxRequestRetries = 10
+
+// requestRetries returns the retries of a row on backendError. The
+// X-Max-Retries header overrides -backend-retries, so a client with its own
+// retry logic can disable the retries of the proxy with 0.
+func requestRetries(r *http.Request) (int, error) {
+	value := r.Header.Get("X-Max-Retries")
+	if value == "" {
+		return Options.BackendRetries, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid X-Max-Retries %s", value)
+	}
+	if n > maxRequestRetries {
+		n = maxRequestRetries
+	}
+	return n, nil
+}
+
+// checkName rejects a project, dataset or table name with "/" or "|".
+// "/" separates the parts of the table path and "|" those of the writer
+// cache key, so such a name could share the writer of another table.
+func checkName(kind, name string) error {
+	if strings.ContainsAny(name, "/|") {
+		return fmt.Errorf("invalid %s %s", kind, name)
+	}
+	return nil
+}
+
+// checkPartitionDecorator validates the partition decorator of a table.
+// A table may target a partition as "table$YYYYMMDD" (also YYYY, YYYYMM
+// and YYYYMMDDHH) or "table$N" for integer range partitions. The table with
+// its decorator is passed to the writer as is, so each partition has its
+// own writer.
+func checkPartitionDecorator(table string) error {
+	i := strings.Index(table, "$")
+	if i < 0 {
+		return nil
+	}
+	name, partition := table[:i], table[i+1:]
+	if name == "" || partition == "" {
+		return fmt.Errorf("invalid partition decorator %s", table)
+	}
+	for _, c := range partition {
+		if c < '0' || c > '9' {
+			return fmt.Errorf("invalid partition decorator %s", table)
+		}
+	}
+	return nil
+}
+
+// splitTablePath splits "project/dataset/table" into its parts.
+func splitTablePath(path string) (string, string, string, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("invalid table %s", path)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// prefersPlainText reports whether the Accept header ranks text/plain
+// above application/json.
+func prefersPlainText(accept string) bool {
+	if accept == "" {
+		return false
+	}
+	plainQ, jsonQ := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		switch mediaType {
+		case "text/plain", "text/*":
+			plainQ = math.Max(plainQ, q)
+		case "application/json", "application/*":
+			jsonQ = math.Max(jsonQ, q)
+		case "*/*":
+			plainQ = math.Max(plainQ, q)
+			jsonQ = math.Max(jsonQ, q)
+		}
+	}
+	return plainQ > jsonQ
+}
+
+// 挿入リクエストとして受け付けるContent-Type
+var supportedContentTypes = []string{
+	"application/json",
+	"application/x-ndjson",
+}
+
+func isSupportedContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range supportedContentTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
 }
 
 const characters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
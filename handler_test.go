@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCloseReportsFailedWriters(t *testing.T) {
+	h := newHttpHandler()
+	ok := &fakeWriter{}
+	failing := &fakeWriter{closeErr: fmt.Errorf("flush failed")}
+	h.writers["|p|d|ok"] = &writerEntry{bigqueryWriter: ok}
+	h.writers["|p|d|failing"] = &writerEntry{bigqueryWriter: failing}
+
+	err := h.Close()
+	if err == nil || !strings.Contains(err.Error(), "1 of 2") {
+		t.Fatalf("Close() = %v, want 1 of 2 writers failed", err)
+	}
+	if ok.closes != 1 || failing.closes != 1 {
+		t.Errorf("closes = %d, %d, want every writer closed once", ok.closes, failing.closes)
+	}
+	if len(h.writers) != 0 {
+		t.Errorf("%d writers left after Close", len(h.writers))
+	}
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	defer func(d time.Duration) { connectRetryInterval = d }(connectRetryInterval)
+	connectRetryInterval = time.Millisecond
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+	writer := &fakeWriter{connectErrs: []error{refused, refused}}
+	if err := connectWithRetry(writer, "email", nil, 2); err != nil {
+		t.Fatalf("connectWithRetry() = %v", err)
+	} else if writer.connects != 3 {
+		t.Errorf("connects = %d, want 3", writer.connects)
+	}
+
+	// 認証エラーは再試行しない
+	writer = &fakeWriter{connectErrs: []error{fmt.Errorf("oauth2: invalid_grant")}}
+	if err := connectWithRetry(writer, "email", nil, 2); err == nil {
+		t.Fatal("connectWithRetry() succeeded after an auth error")
+	} else if writer.connects != 1 {
+		t.Errorf("connects = %d, want 1", writer.connects)
+	}
+}
+
+func TestGetBigqueryWriterConnectsOnce(t *testing.T) {
+	var mu sync.Mutex
+	var writers []*fakeWriter
+	defer func(f func(string, string, string) bigqueryWriter) { newWriter = f }(newWriter)
+	newWriter = func(project, dataset, table string) bigqueryWriter {
+		mu.Lock()
+		defer mu.Unlock()
+		w := &fakeWriter{connectDelay: 10 * time.Millisecond}
+		writers = append(writers, w)
+		return w
+	}
+
+	h := newHttpHandler()
+	start := make(chan struct{})
+	entries := make(chan *writerEntry, 50)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(entries); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			entry, err := h.getBigqueryWriter("", "p", "d", "t")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			entry.release()
+			entries <- entry
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(entries)
+
+	first := <-entries
+	for entry := range entries {
+		if entry != first {
+			t.Fatal("requests got different writers for the same table")
+		}
+	}
+	if len(writers) != 1 || writers[0].connects != 1 {
+		t.Errorf("created %d writers, want exactly one Connect", len(writers))
+	}
+}
+
+func TestAddReconnectsAfterAuthError(t *testing.T) {
+	expired := &fakeWriter{addErrs: []error{fmt.Errorf("googleapi: Error 401: Request had invalid authentication credentials")}}
+	renewed := &fakeWriter{}
+	created := []*fakeWriter{expired, renewed}
+	defer func(f func(string, string, string) bigqueryWriter) { newWriter = f }(newWriter)
+	newWriter = func(project, dataset, table string) bigqueryWriter {
+		w := created[0]
+		created = created[1:]
+		return w
+	}
+
+	h := newHttpHandler()
+	entry, err := h.getBigqueryWriter("", "p", "d", "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.created = time.Now().Add(-2 * reconnectInterval)
+
+	if err := entry.Add("id", map[string]interface{}{"a": 1}); err != nil {
+		t.Fatalf("Add() = %v, want the row retried with a new writer", err)
+	}
+	entry.release()
+	h.retiring.Wait()
+
+	if len(renewed.rows) != 1 {
+		t.Errorf("renewed writer has %d rows, want 1", len(renewed.rows))
+	}
+	if expired.closes != 1 {
+		t.Errorf("expired writer closed %d times, want 1", expired.closes)
+	}
+	if h.writers["|p|d|t"].bigqueryWriter != renewed {
+		t.Error("the table does not use the renewed writer")
+	}
+
+	// 作り直した直後のwriterは再び作り直さない
+	renewed.addErrs = []error{fmt.Errorf("oauth2: invalid_grant")}
+	next, err := h.getBigqueryWriter("", "p", "d", "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.release()
+	if err := next.Add("id2", map[string]interface{}{"a": 2}); err == nil || !isAuthError(err) {
+		t.Errorf("Add() = %v, want the auth error", err)
+	}
+}
+
+func TestIsSupportedContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"application/x-ndjson", true},
+		{"application/x-ndjson; charset=utf-8", true},
+		{"application/x-www-form-urlencoded", false},
+		{"text/plain", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isSupportedContentType(tt.contentType); got != tt.want {
+			t.Errorf("isSupportedContentType(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestCanaryCacheReusesResult(t *testing.T) {
+	defer func(d time.Duration) { Options.CanaryInterval = d }(Options.CanaryInterval)
+	Options.CanaryInterval = time.Hour
+
+	var c canaryCache
+	checks := 0
+	check := func() error {
+		checks++
+		return fmt.Errorf("quota exceeded")
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.get(check); err == nil {
+			t.Fatal("get() = nil, want the cached error")
+		}
+	}
+	if checks != 1 {
+		t.Errorf("%d canary inserts, want 1 within -canary-interval", checks)
+	}
+
+	c.checked = time.Now().Add(-2 * time.Hour)
+	c.get(check)
+	if checks != 2 {
+		t.Errorf("%d canary inserts, want a new one after -canary-interval", checks)
+	}
+}
+
+func TestResponseShapes(t *testing.T) {
+	resp := &response{Errors: []*writeError{{Index: 1, Error: errRowNotObject}}}
+	body, err := marshalResponse(resp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"errors":[{"index":1,"error":"row must be a JSON object"}]}`; string(body) != want {
+		t.Errorf("response = %s, want %s", body, want)
+	}
+
+	body, err = marshalResponse(&response{Errors: make([]*writeError, 0)}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"errors":[]}`; string(body) != want {
+		t.Errorf("response = %s, want %s", body, want)
+	}
+}
+
+// TestConcurrentAddsShareWriter writes chunks of several requests to the
+// cached writer of one table at the same time. Run it with -race.
+func TestConcurrentAddsShareWriter(t *testing.T) {
+	writer := &fakeWriter{}
+	defer func(f func(string, string, string) bigqueryWriter) { newWriter = f }(newWriter)
+	newWriter = func(project, dataset, table string) bigqueryWriter { return writer }
+	defer func(rows, concurrency int) {
+		Options.ChunkRows, Options.ChunkConcurrency = rows, concurrency
+	}(Options.ChunkRows, Options.ChunkConcurrency)
+	Options.ChunkRows = 10
+	Options.ChunkConcurrency = 4
+
+	h := newHttpHandler()
+	h.setReady(true)
+	var body strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&body, `{"id": %d}`+"\n", i)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/p/d/t", strings.NewReader(body.String())))
+			if w.Code != http.StatusOK {
+				t.Errorf("status = %d: %s", w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(writer.rows) != 400 {
+		t.Errorf("%d rows written, want 400", len(writer.rows))
+	}
+	tables := h.tableStatuses()
+	if len(tables) != 1 || tables[0].Rows != 400 || tables[0].InFlight != 0 {
+		t.Errorf("tables = %+v, want one writer with 400 rows", tables)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headerFlag is a repeatable flag of "Key: value" response headers.
+type headerFlag http.Header
+
+func (f headerFlag) String() string {
+	parts := make([]string, 0, len(f))
+	for key, values := range f {
+		for _, value := range values {
+			parts = append(parts, key+": "+value)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (f headerFlag) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return fmt.Errorf("invalid header %s", s)
+	}
+	key := http.CanonicalHeaderKey(strings.TrimSpace(s[:i]))
+	if key == "Content-Type" {
+		// Content-Typeはハンドラが設定する
+		return fmt.Errorf("Content-Type can not be set")
+	}
+	http.Header(f).Add(key, strings.TrimSpace(s[i+1:]))
+	return nil
+}
+
+// withResponseHeaders sets the -response-header headers on every response.
+// They are set before the handler runs, so the handler can override them.
+func withResponseHeaders(handler http.Handler) http.Handler {
+	if len(Options.ResponseHeaders) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		for key, values := range Options.ResponseHeaders {
+			header[key] = values
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
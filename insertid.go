@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// insertIdFunc derives the insertId of a row. length is the length of
+// random insertIds for the table.
+type insertIdFunc func(row map[string]interface{}, length int) (string, error)
+
+// insertIdFuncs are the insertId strategies selectable by name in the
+// insert_id of the -table-config file. A custom build can add its own
+// strategy with registerInsertIdFunc in an init function.
+var insertIdFuncs = map[string]insertIdFunc{
+	"random": randomInsertId,
+	"hash":   hashInsertId,
+}
+
+func registerInsertIdFunc(name string, fn insertIdFunc) {
+	if strings.Contains(name, ":") {
+		// "field:"のように引数を取る名前と区別する
+		panic("invalid insert id strategy " + name)
+	}
+	insertIdFuncs[name] = fn
+}
+
+func randomInsertId(row map[string]interface{}, length int) (string, error) {
+	return generateInsertId(length), nil
+}
+
+func hashInsertId(row map[string]interface{}, length int) (string, error) {
+	// encoding/jsonはマップのキーをソートするので同じ行は同じ値になる
+	data, err := json.Marshal(row)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// fieldInsertId returns the strategy using the value of the field.
+func fieldInsertId(field string) insertIdFunc {
+	return func(row map[string]interface{}, length int) (string, error) {
+		key, ok := row[field]
+		if !ok || key == nil {
+			return "", fmt.Errorf("key field %s is missing", field)
+		}
+		return fmt.Sprint(key), nil
+	}
+}
+
+// tableInsertId returns the insertId of a row that the proxy writes by
+// itself, such as the canary row, with the strategy of the table.
+func tableInsertId(table string, row map[string]interface{}) (string, error) {
+	config := tableConfigFor(table)
+	return insertIdFor(config.InsertId, row, config.idLength())
+}
+
+// insertIdFor returns the insertId of the row by the strategy.
+// The field strategy uses the key as is, and BigQuery only de-duplicates
+// rows with the same insertId on a best-effort basis for a short period,
+// so this is not a real upsert.
+func insertIdFor(strategy string, row map[string]interface{}, idLength int) (string, error) {
+	if strings.HasPrefix(strategy, "field:") {
+		return fieldInsertId(strings.TrimPrefix(strategy, "field:"))(row, idLength)
+	} else if fn, ok := insertIdFuncs[strategy]; ok {
+		return fn(row, idLength)
+	}
+	return randomInsertId(row, idLength)
+}
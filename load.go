@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// loadRequest is the body of POST /load/{project}/{dataset}/{table}.
+type loadRequest struct {
+	SourceURIs   []string `json:"source_uris"`
+	SourceFormat string   `json:"source_format"`
+}
+
+type loadJob struct {
+	JobReference struct {
+		ProjectID string `json:"projectId"`
+		JobID     string `json:"jobId"`
+	} `json:"jobReference"`
+	Configuration struct {
+		Load struct {
+			SourceURIs       []string `json:"sourceUris"`
+			SourceFormat     string   `json:"sourceFormat"`
+			WriteDisposition string   `json:"writeDisposition"`
+			DestinationTable struct {
+				ProjectID string `json:"projectId"`
+				DatasetID string `json:"datasetId"`
+				TableID   string `json:"tableId"`
+			} `json:"destinationTable"`
+		} `json:"load"`
+	} `json:"configuration"`
+	Status *struct {
+		State       string        `json:"state"`
+		ErrorResult interface{}   `json:"errorResult,omitempty"`
+		Errors      []interface{} `json:"errors,omitempty"`
+	} `json:"status,omitempty"`
+}
+
+// serveLoad handles the load job endpoints, an ingestion path for bulk
+// data in GCS that does not use streaming inserts.
+//
+//	POST /load/{project}/{dataset}/{table} starts a load job
+//	GET  /load/status/{job}                returns the state of the job
+func (h *httpHandler) serveLoad(w http.ResponseWriter, r *http.Request) {
+	if !Options.EnableLoad || h.api == nil {
+		h.notFound(w, r, "load jobs are disabled")
+		return
+	}
+
+	params := strings.Split(strings.TrimPrefix(r.URL.Path, "/load/"), "/")
+	if len(params) == 2 && params[0] == "status" && r.Method == "GET" {
+		h.serveLoadStatus(w, r, params[1])
+		return
+	} else if len(params) != 3 || params[0] == "" || params[1] == "" || params[2] == "" {
+		h.badRequest(w, r, "invalid uri")
+		return
+	} else if r.Method != "POST" {
+		h.methodNotAllowed(w, r, "method not allowed")
+		return
+	}
+
+	project, dataset, table := params[0], params[1], params[2]
+	switch authorizeProject(r, project) {
+	case http.StatusUnauthorized:
+		h.unauthorized(w, r, "unauthorized")
+		return
+	case http.StatusForbidden:
+		h.forbidden(w, r, "project is not allowed")
+		return
+	}
+
+	if !isDatasetAllowed(dataset) {
+		h.forbidden(w, r, errDatasetNotAllowed.Error())
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	}
+
+	var req loadRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	} else if len(req.SourceURIs) == 0 {
+		h.badRequest(w, r, "source_uris required")
+		return
+	}
+	for _, uri := range req.SourceURIs {
+		if !strings.HasPrefix(uri, "gs://") {
+			h.badRequest(w, r, fmt.Sprintf("invalid source uri %s", uri))
+			return
+		}
+	}
+	if req.SourceFormat == "" {
+		req.SourceFormat = "NEWLINE_DELIMITED_JSON"
+	}
+
+	job := &loadJob{}
+	job.JobReference.ProjectID = project
+	job.JobReference.JobID = "bqproxy_" + generateInsertId(16)
+	load := &job.Configuration.Load
+	load.SourceURIs = req.SourceURIs
+	load.SourceFormat = req.SourceFormat
+	load.WriteDisposition = "WRITE_APPEND"
+	load.DestinationTable.ProjectID = project
+	load.DestinationTable.DatasetID = dataset
+	load.DestinationTable.TableID = table
+
+	var created loadJob
+	if err := h.api.call("POST", "/projects/"+url.PathEscape(project)+"/jobs", job, &created); err != nil {
+		h.internalError(w, r, err.Error())
+		return
+	}
+
+	// ジョブの取得にはプロジェクトが必要なのでIDに含める
+	resp, _ := json.Marshal(map[string]string{
+		"job_id": created.JobReference.ProjectID + ":" + created.JobReference.JobID,
+	})
+	h.ok(w, resp)
+}
+
+func (h *httpHandler) serveLoadStatus(w http.ResponseWriter, r *http.Request, id string) {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		h.badRequest(w, r, "invalid job id")
+		return
+	}
+
+	switch authorizeProject(r, parts[0]) {
+	case http.StatusUnauthorized:
+		h.unauthorized(w, r, "unauthorized")
+		return
+	case http.StatusForbidden:
+		h.forbidden(w, r, "project is not allowed")
+		return
+	}
+
+	var job loadJob
+	path := "/projects/" + url.PathEscape(parts[0]) + "/jobs/" + url.PathEscape(parts[1])
+	if err := h.api.call("GET", path, nil, &job); err != nil {
+		if e, ok := err.(*apiError); ok && e.StatusCode == http.StatusNotFound {
+			h.notFound(w, r, "job not found")
+			return
+		}
+		h.internalError(w, r, err.Error())
+		return
+	}
+
+	resp, err := json.Marshal(map[string]interface{}{
+		"job_id": id,
+		"status": job.Status,
+	})
+	if err != nil {
+		h.internalError(w, r, err.Error())
+		return
+	}
+	h.ok(w, resp)
+}
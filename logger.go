@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/najeira/goutils/nlog"
+)
+
+// instanceLogger adds the instance id to every log message.
+type instanceLogger struct {
+	nlog.Logger
+	prefix string
+}
+
+func (l *instanceLogger) Debugf(format string, args ...interface{}) {
+	l.Logger.Debugf(l.prefix+format, args...)
+}
+
+func (l *instanceLogger) Infof(format string, args ...interface{}) {
+	l.Logger.Infof(l.prefix+format, args...)
+}
+
+func (l *instanceLogger) Noticef(format string, args ...interface{}) {
+	l.Logger.Noticef(l.prefix+format, args...)
+}
+
+func (l *instanceLogger) Warnf(format string, args ...interface{}) {
+	l.Logger.Warnf(l.prefix+format, args...)
+}
+
+func (l *instanceLogger) Errorf(format string, args ...interface{}) {
+	l.Logger.Errorf(l.prefix+format, args...)
+}
+
+func (l *instanceLogger) Criticalf(format string, args ...interface{}) {
+	l.Logger.Criticalf(l.prefix+format, args...)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/najeira/goutils/nlog"
@@ -10,6 +12,10 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -19,34 +25,283 @@ var logger nlog.Logger = nil
 var Options struct {
 	FD      uint
 	Port    int
+	Socket  string
 	Email   string
-	Pem     []byte
+	Pem     []byte `json:"-"`
 	Logging string
+
+	RequireContentType bool
+	FormField          string
+	KeyField           string
+	ConnectRetries     int
+	WriterMaxAge       time.Duration
+	CanaryTable        string
+	CanaryInterval     time.Duration
+	MaxRows            int
+	MaxErrors          int
+	RecentErrors       int
+	SampleRate         float64
+	SampleTable        string
+	ReadHeaderTimeout  time.Duration
+	ReadTimeout        time.Duration
+	IdleTimeout        time.Duration
+	MaxHeaderBytes     int
+	MaxPathLength      int
+	ShutdownTimeout    time.Duration
+	DrainGrace         time.Duration
+	ShutdownMode       string
+	UserAgent          string
+	BreakerThreshold   int
+	BreakerCooldown    time.Duration
+	StripFieldPrefix   string
+	Bind               string
+	WriteConcurrency   int
+	ShedThreshold      float64
+	ChunkRows          int
+	ChunkConcurrency   int
+	BackendRetries     int
+	RateLimitRetry     time.Duration
+	StreamChunkRows    int
+	InferSchema        bool
+	MaxRowAge          time.Duration
+	RowTimeField       string
+	RowTimeStrict      bool
+	IgnoreParseErrors  bool
+	InsertIdRetries    int
+	InsertIdLength     int
+	SlowThreshold      time.Duration
+	SLODeadline        time.Duration
+	EnableLoad         bool
+	EnableSchema       bool
+	CheckDataset       bool
+	ReusePort          int
+	DeadLetterTable    string
+	MaxTables          int
+	OTel               bool
+	StatsdAddr         string
+	ReadOnly           bool
+	ReadOnlyFile       string
+	InstanceId         string
+	RootMode           string
+	RootRedirect       string
+	AsyncStatusTTL     time.Duration
+	MaxConnsPerIP      int
+	MaxConnRequests    int64
+	MaxConnRows        int64
+	TLSCert            string
+	TLSKey             string
+	TLSMinVersion      string
+	TLSCiphers         string
+	MaxBufferBytes     int64
+	MaxQueuedRows      int64
+
+	// SlackなどのURLは秘密のトークンを含む
+	ErrorWebhook         string `json:"-"`
+	ErrorWebhookRatio    float64
+	ErrorWebhookInterval time.Duration
+
+	AdminToken string                 `json:"-"`
+	Tokens     map[string]*tokenGrant `json:"-"`
+
+	TableConfigs map[string]*tableConfig
+	Credentials  map[string]*credential `json:"-"`
+
+	ResponseHeaders http.Header
+	AllowDatasets   map[string]bool
 }
 
 func initOptions() {
 	var pemFile string
+	var tokenFile string
+	var tableConfigFile string
+	var credentialsFile string
+	var allowDatasets string
 
 	flag.UintVar(&Options.FD, "fd", 0, "file descriptor")
 	flag.IntVar(&Options.Port, "port", 0, "port")
+	flag.StringVar(&Options.Socket, "socket", "", "unix socket path, can be used with -port")
 	flag.StringVar(&Options.Email, "email", "", "bigquery account email")
 	flag.StringVar(&pemFile, "pem", "", "bigquery PEM file")
 	flag.StringVar(&Options.Logging, "logging", "warn", "log level")
+	flag.BoolVar(&Options.RequireContentType, "require-content-type", false, "reject inserts without a JSON content type")
+	flag.StringVar(&Options.FormField, "form-field", "payload", "form field with the rows of an application/x-www-form-urlencoded body (empty disables)")
+	flag.StringVar(&Options.KeyField, "key-field", "id", "row field used as insertId for PUT requests")
+	flag.IntVar(&Options.ConnectRetries, "connect-retries", 2, "retries for transient bigquery connect errors")
+	flag.DurationVar(&Options.WriterMaxAge, "writer-max-age", 0, "reconnect writers older than this (0 disables)")
+	flag.StringVar(&Options.CanaryTable, "canary-table", "", "project/dataset/table written by /healthz?deep=1, with a checked_at INTEGER column")
+	flag.DurationVar(&Options.CanaryInterval, "canary-interval", time.Minute, "time the result of a /healthz?deep=1 canary insert is reused")
+	flag.IntVar(&Options.MaxRows, "max-rows", 0, "max rows per request (0 is unlimited)")
+	flag.IntVar(&Options.RecentErrors, "recent-errors", 100, "number of recent row errors kept for /admin/errors")
+	flag.IntVar(&Options.MaxErrors, "max-errors", 0, "max errors returned in a response (0 is unlimited)")
+	flag.Float64Var(&Options.SampleRate, "sample-rate", 0, "fraction of rows logged at debug for -sample-table")
+	flag.StringVar(&Options.SampleTable, "sample-table", "", "project/dataset/table whose rows are sampled")
+	flag.DurationVar(&Options.ReadHeaderTimeout, "read-header-timeout", time.Second*10, "timeout for reading request headers")
+	flag.DurationVar(&Options.ReadTimeout, "read-timeout", 0, "timeout for reading a whole request including the body (0 is unlimited)")
+	flag.DurationVar(&Options.IdleTimeout, "idle-timeout", time.Second*120, "keep-alive idle timeout")
+	flag.IntVar(&Options.MaxPathLength, "max-path-length", 1024, "max request path length (0 is unlimited)")
+	flag.IntVar(&Options.MaxHeaderBytes, "max-header-bytes", http.DefaultMaxHeaderBytes, "max request header bytes")
+	flag.DurationVar(&Options.ShutdownTimeout, "shutdown-timeout", time.Second*30, "time to wait for in-flight requests on shutdown")
+	flag.StringVar(&Options.ShutdownMode, "shutdown-mode", "flush", "flush the writers on shutdown, or fast to exit without flushing")
+	flag.DurationVar(&Options.DrainGrace, "drain-grace", 0, "time to serve without keep-alive before shutdown")
+	flag.StringVar(&Options.UserAgent, "bq-user-agent", "bq-proxy/"+version, "User-Agent for the bigquery API requests made by the proxy itself, not for the inserts of the writer")
+	flag.IntVar(&Options.BreakerThreshold, "breaker-threshold", 0, "consecutive failures that open a table's circuit breaker (0 disables)")
+	flag.DurationVar(&Options.BreakerCooldown, "breaker-cooldown", time.Second*30, "time a circuit breaker stays open")
+	flag.StringVar(&Options.StripFieldPrefix, "strip-field-prefix", "", "prefix removed from top-level field names")
+	flag.StringVar(&Options.Bind, "bind", "", "host to listen on with -port (default all interfaces)")
+	flag.IntVar(&Options.WriteConcurrency, "global-write-concurrency", 0, "max concurrent batch writes across all tables (0 is unlimited)")
+	flag.Float64Var(&Options.ShedThreshold, "shed-threshold", 0, "fraction of global-write-concurrency at which X-Priority: low requests are rejected (0 is disabled)")
+	flag.IntVar(&Options.ChunkRows, "chunk-rows", 500, "rows per chunk of a large batch written concurrently")
+	flag.IntVar(&Options.ChunkConcurrency, "chunk-concurrency", 1, "max chunks of a batch written at the same time")
+	flag.StringVar(&Options.ErrorWebhook, "error-webhook", "", "URL notified when a batch has a high error ratio")
+	flag.Float64Var(&Options.ErrorWebhookRatio, "error-webhook-ratio", 0.5, "error ratio of a batch that triggers the webhook")
+	flag.DurationVar(&Options.ErrorWebhookInterval, "error-webhook-interval", time.Minute, "minimum interval between webhook posts")
+	flag.DurationVar(&Options.RateLimitRetry, "rate-limit-retry-after", time.Second*30, "Retry-After of a request throttled by bigquery")
+	flag.IntVar(&Options.BackendRetries, "backend-retries", 0, "retries of a row when bigquery returns backendError")
+	flag.StringVar(&Options.AdminToken, "admin-token", "", "bearer token required by the admin endpoints (empty disables them)")
+	flag.IntVar(&Options.StreamChunkRows, "stream-chunk-rows", 1000, "rows per progress object with ?stream=1")
+	flag.BoolVar(&Options.InferSchema, "infer-schema", false, "validate rows against a schema inferred from the first batch of each table")
+	flag.DurationVar(&Options.MaxRowAge, "max-row-age", 0, "reject rows older than this (0 disables)")
+	flag.StringVar(&Options.RowTimeField, "row-time-field", "timestamp", "row field checked by -max-row-age")
+	flag.BoolVar(&Options.RowTimeStrict, "row-time-strict", false, "reject rows without -row-time-field when -max-row-age is set")
+	flag.BoolVar(&Options.IgnoreParseErrors, "ignore-parse-errors", false, "return unparseable lines as warnings instead of errors")
+	flag.StringVar(&tokenFile, "token-file", "", "JSON file mapping insert tokens to allowed projects and credentials")
+	flag.IntVar(&Options.InsertIdLength, "insert-id-length", 10, "length of random insertIds")
+	flag.IntVar(&Options.InsertIdRetries, "insert-id-retries", 0, "retries with a new insertId when bigquery rejects the insertId")
+	flag.DurationVar(&Options.SlowThreshold, "slow-threshold", 0, "log insert requests slower than this (0 disables)")
+	flag.DurationVar(&Options.SLODeadline, "slo-deadline", 0, "return 503 to requests with X-SLO-Deadline: 1 when the insert takes longer than this (0 disables)")
+	flag.BoolVar(&Options.EnableLoad, "enable-load", false, "enable the /load endpoints for GCS load jobs")
+	flag.BoolVar(&Options.CheckDataset, "check-dataset", false, "check that the dataset exists before creating a writer")
+	flag.BoolVar(&Options.EnableSchema, "enable-schema", false, "enable the /schema endpoints to create tables")
+	flag.IntVar(&Options.ReusePort, "reuseport", 0, "number of SO_REUSEPORT listeners on -port (0 disables)")
+	flag.StringVar(&Options.DeadLetterTable, "deadletter-table", "", "project/dataset/table receiving rows that failed")
+	flag.StringVar(&tableConfigFile, "table-config", "", "JSON file with per-table configuration")
+	flag.StringVar(&credentialsFile, "credentials", "", "JSON file with named credentials selected by X-Credential")
+	flag.IntVar(&Options.MaxTables, "max-tables", 0, "max distinct tables with a writer (0 is unlimited)")
+	flag.BoolVar(&Options.OTel, "otel", false, "export OpenTelemetry traces with OTLP")
+	flag.StringVar(&Options.StatsdAddr, "statsd-addr", "", "send metrics to this StatsD host:port over UDP (empty disables)")
+	Options.ResponseHeaders = make(http.Header)
+	flag.Var(headerFlag(Options.ResponseHeaders), "response-header", "header set on all responses as \"Key: value\" (repeatable)")
+	flag.StringVar(&Options.TLSCert, "tls-cert", "", "TLS certificate file to serve HTTPS")
+	flag.StringVar(&Options.TLSKey, "tls-key", "", "TLS private key file to serve HTTPS")
+	flag.StringVar(&Options.TLSMinVersion, "tls-min-version", "1.2", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&Options.TLSCiphers, "tls-ciphers", "", "comma-separated TLS cipher suites (empty uses the defaults)")
+	flag.IntVar(&Options.MaxConnsPerIP, "max-conns-per-ip", 0, "max connections from a remote IP (0 is unlimited)")
+	flag.Int64Var(&Options.MaxConnRequests, "max-conn-requests", 0, "close a connection after this many requests (0 is unlimited)")
+	flag.Int64Var(&Options.MaxConnRows, "max-conn-rows", 0, "close a connection after this many rows (0 is unlimited)")
+	flag.DurationVar(&Options.AsyncStatusTTL, "async-status-ttl", time.Minute*10, "time to keep the status of async batches")
+	flag.StringVar(&allowDatasets, "allow-datasets", "", "comma-separated datasets the proxy may write to (empty allows all)")
+	flag.StringVar(&Options.RootMode, "root-mode", "status", "response of /: status, health or redirect")
+	flag.StringVar(&Options.RootRedirect, "root-redirect", "", "redirect URL of / with -root-mode=redirect")
+	flag.StringVar(&Options.InstanceId, "instance-id", hostname(), "instance label of the metrics and the logs")
+	flag.BoolVar(&Options.ReadOnly, "readonly", false, "reject inserts with 503 for maintenance")
+	flag.StringVar(&Options.ReadOnlyFile, "readonly-file", "", "read-only while this file exists, checked at startup and on SIGHUP")
+	flag.Int64Var(&Options.MaxQueuedRows, "max-queued-rows", 0, "max total rows of requests in progress (0 is unlimited)")
+	flag.Int64Var(&Options.MaxBufferBytes, "max-buffer-bytes", 0, "max total bytes of request bodies in progress (0 is unlimited)")
 	flag.Parse()
 
-	if err := checkOptions(pemFile); err != nil {
+	if allowDatasets != "" {
+		Options.AllowDatasets = make(map[string]bool)
+		for _, dataset := range strings.Split(allowDatasets, ",") {
+			if dataset = strings.TrimSpace(dataset); dataset != "" {
+				Options.AllowDatasets[dataset] = true
+			}
+		}
+	}
+
+	if err := checkOptions(pemFile, tokenFile, tableConfigFile, credentialsFile); err != nil {
 		flag.Usage()
 		fatal(err)
 	}
 }
 
-func checkOptions(pemFile string) error {
+func checkOptions(pemFile, tokenFile, tableConfigFile, credentialsFile string) error {
 	if Options.Email == "" {
 		return fmt.Errorf("account required.")
 	} else if pemFile == "" {
 		return fmt.Errorf("pem required.")
-	} else if Options.FD == 0 && Options.Port == 0 {
-		return fmt.Errorf("fd or port required.")
+	} else if _, ok := systemdListenFD(); !ok && Options.FD == 0 && Options.Port == 0 && Options.Socket == "" {
+		return fmt.Errorf("fd, port or socket required.")
+	}
+
+	if Options.Port < 0 || Options.Port > 65535 {
+		return fmt.Errorf("invalid port %d.", Options.Port)
+	} else if Options.ReusePort > 0 && Options.Port == 0 {
+		return fmt.Errorf("reuseport requires port.")
+	} else if Options.Bind != "" && Options.Port == 0 {
+		return fmt.Errorf("bind requires port.")
+	} else if strings.Contains(Options.Bind, ":") && net.ParseIP(Options.Bind) == nil {
+		// ホスト名かIPアドレスのみで、ポートは含めない
+		return fmt.Errorf("invalid bind address %s.", Options.Bind)
+	}
+
+	if Options.SampleRate < 0 || Options.SampleRate > 1 {
+		return fmt.Errorf("sample-rate must be between 0 and 1.")
+	}
+
+	if Options.ShedThreshold < 0 || Options.ShedThreshold > 1 {
+		return fmt.Errorf("shed-threshold must be between 0 and 1.")
+	} else if Options.ShedThreshold > 0 && Options.WriteConcurrency <= 0 {
+		return fmt.Errorf("shed-threshold requires global-write-concurrency.")
+	}
+
+	if err := checkInsertIdLength(Options.InsertIdLength); err != nil {
+		return fmt.Errorf("%v.", err)
+	}
+
+	if (Options.TLSCert == "") != (Options.TLSKey == "") {
+		return fmt.Errorf("tls-cert and tls-key must be set together.")
+	} else if _, err := newTLSConfig(); err != nil {
+		return fmt.Errorf("%v.", err)
+	}
+
+	switch Options.RootMode {
+	case "status", "health":
+	case "redirect":
+		if Options.RootRedirect == "" {
+			return fmt.Errorf("root-mode redirect requires root-redirect.")
+		}
+	default:
+		return fmt.Errorf("invalid root-mode %s.", Options.RootMode)
+	}
+
+	if Options.ShutdownMode != "flush" && Options.ShutdownMode != "fast" {
+		return fmt.Errorf("shutdown-mode must be flush or fast.")
+	}
+
+	if Options.CanaryTable != "" {
+		if _, _, _, err := splitTablePath(Options.CanaryTable); err != nil {
+			return err
+		}
+	}
+
+	if Options.DeadLetterTable != "" {
+		if _, _, _, err := splitTablePath(Options.DeadLetterTable); err != nil {
+			return err
+		}
+	}
+
+	if tokenFile != "" {
+		tokens, err := loadTokenFile(tokenFile)
+		if err != nil {
+			return err
+		}
+		Options.Tokens = tokens
+	}
+
+	if tableConfigFile != "" {
+		configs, err := loadTableConfig(tableConfigFile)
+		if err != nil {
+			return err
+		}
+		Options.TableConfigs = configs
+	}
+
+	if credentialsFile != "" {
+		creds, err := loadCredentials(credentialsFile)
+		if err != nil {
+			return err
+		}
+		Options.Credentials = creds
 	}
 
 	f, err := os.Open(pemFile)
@@ -61,10 +316,60 @@ func checkOptions(pemFile string) error {
 		return err
 	}
 
+	// 最初のリクエストで失敗しないように起動時に鍵を検証する
+	if _, err := parsePrivateKey(pem); err != nil {
+		return fmt.Errorf("invalid pem %s: %v", pemFile, err)
+	}
+
 	Options.Pem = pem
 	return nil
 }
 
+// logConfig writes the effective options at startup. Secrets are excluded
+// from the JSON by their struct tags.
+func logConfig() {
+	body, err := json.Marshal(&Options)
+	if err != nil {
+		logger.Errorf("config: %v", err)
+		return
+	}
+	logger.Warnf("config: listener=%s credentials=%s logging=%s options=%s",
+		describeListener(), describeCredentials(), Options.Logging, body)
+}
+
+func describeListener() string {
+	if fd, ok := systemdListenFD(); ok {
+		return fmt.Sprintf("systemd:%d", fd)
+	} else if Options.FD != 0 {
+		return fmt.Sprintf("fd:%d", Options.FD)
+	}
+	parts := make([]string, 0, 2)
+	if Options.Port != 0 {
+		tcp := "tcp:" + net.JoinHostPort(Options.Bind, strconv.Itoa(Options.Port))
+		if Options.ReusePort > 0 {
+			tcp += fmt.Sprintf("*%d", Options.ReusePort)
+		}
+		parts = append(parts, tcp)
+	}
+	if Options.Socket != "" {
+		parts = append(parts, "unix:"+Options.Socket)
+	}
+	return strings.Join(parts, ",")
+}
+
+func describeCredentials() string {
+	desc := "pem:" + Options.Email
+	if len(Options.Credentials) > 0 {
+		names := make([]string, 0, len(Options.Credentials))
+		for name := range Options.Credentials {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		desc += ",named:" + strings.Join(names, "+")
+	}
+	return desc
+}
+
 func fatal(err error) {
 	logger.Errorf("%v", err)
 	os.Exit(1)
@@ -80,52 +385,215 @@ func main() {
 	// parse flags
 	initOptions()
 
+	// 複数台のログを区別できるようにする
+	if Options.InstanceId != "" {
+		prefix := "instance=" + strings.Replace(Options.InstanceId, "%", "%%", -1) + " "
+		logger = &instanceLogger{Logger: logger, prefix: prefix}
+	}
+
 	// update logging level
 	logger.SetLevelName(Options.Logging)
 
+	// 実際に動いている設定をログから分かるようにする
+	logConfig()
+
+	// プロキシ自身のbigqueryへのリクエストにUser-Agentを付ける
+	apiClient = newAPIClient(Options.UserAgent)
+
+	// tracing
+	if Options.OTel {
+		if err := initTracing(); err != nil {
+			fatal(err)
+			return
+		}
+	}
+
+	// /metricsとは別にStatsDへも送る
+	if Options.StatsdAddr != "" {
+		if err := initStatsd(Options.StatsdAddr); err != nil {
+			fatal(err)
+			return
+		}
+	}
+
+	// 全テーブルで共有する書き込みの同時実行数
+	initWriteSemaphore(Options.WriteConcurrency)
+
+	// handler
+	handler := newHttpHandler()
+	handler.setReadOnly(Options.ReadOnly || readOnlyFileExists())
+	if Options.EnableLoad || Options.EnableSchema || Options.CheckDataset || Options.CanaryTable != "" {
+		tokens, err := newJWTTokenSource(Options.Email, Options.Pem)
+		if err != nil {
+			fatal(err)
+			return
+		}
+		handler.api = &bigqueryAPI{tokens: tokens}
+	}
+
 	// listen
-	ln, err := listen()
+	lns, err := listen()
 	if err != nil {
 		fatal(err)
 		return
 	}
 
-	// handler
-	handler := newHttpHandler()
+	srv := newServer(handler)
+	handler.server = srv
 
 	// signal handler
-	done := runSignalHandler(ln, handler)
+	done := runSignalHandler(srv, handler)
+
+	// 初期化がすべて終わってからリクエストを受け付ける
+	handler.setReady(true)
 
 	// start server
-	timeoutHandler := http.TimeoutHandler(handler, time.Second*60, "")
-	if err := http.Serve(ln, timeoutHandler); err != nil {
-		// signalなどで閉じられるとerrが返ってくる
-		logger.Noticef("%v", err)
-	} else {
-		logger.Noticef("server closed")
-	}
+	serveAll(srv, lns)
 
 	// サーバとワーカの終了まで待つ
 	<-done
 }
 
-func runSignalHandler(ln net.Listener, handler *httpHandler) chan struct{} {
+// readOnlyFileExists reports whether the -readonly-file exists.
+func readOnlyFileExists() bool {
+	if Options.ReadOnlyFile == "" {
+		return false
+	}
+	_, err := os.Stat(Options.ReadOnlyFile)
+	return err == nil
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+func newServer(handler http.Handler) *http.Server {
+	timeoutHandler := http.TimeoutHandler(handler, time.Second*60, "")
+	srv := &http.Server{
+		Handler: withResponseHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// 上限に達したリクエストの応答で接続を閉じる
+			checkConnQuota(w, r)
+
+			// ストリーミングは進捗を返し続けるのでタイムアウトの対象外
+			// TimeoutHandlerはFlushもできない
+			if isStreamRequest(r) {
+				handler.ServeHTTP(w, r)
+				return
+			}
+			// 本文の読み込みが-read-timeoutを過ぎると接続のcontextが
+			// キャンセルされ、TimeoutHandlerが先に503を返してしまう
+			// 408はハンドラが返すので、キャンセルを伝えない
+			timeoutHandler.ServeHTTP(w, r.WithContext(context.WithoutCancel(r.Context())))
+		})),
+		ReadHeaderTimeout: Options.ReadHeaderTimeout,
+		ReadTimeout:       Options.ReadTimeout,
+		IdleTimeout:       Options.IdleTimeout,
+		MaxHeaderBytes:    Options.MaxHeaderBytes,
+	}
+	var hooks []func(net.Conn, http.ConnState)
+	if Options.MaxConnsPerIP > 0 {
+		hooks = append(hooks, newConnLimiter(Options.MaxConnsPerIP).connState)
+	}
+	if Options.MaxConnRequests > 0 || Options.MaxConnRows > 0 {
+		quotas := newConnQuotas()
+		srv.ConnContext = quotas.connContext
+		hooks = append(hooks, quotas.connState)
+	}
+	if len(hooks) > 0 {
+		srv.ConnState = func(c net.Conn, state http.ConnState) {
+			for _, hook := range hooks {
+				hook(c, state)
+			}
+		}
+	}
+	if Options.TLSCert != "" {
+		// checkOptionsで検証済み
+		srv.TLSConfig, _ = newTLSConfig()
+	}
+	return srv
+}
+
+// serveAll serves every listener in its own goroutine and waits until all
+// of them are closed. srv.Shutdown closes all the listeners.
+func serveAll(srv *http.Server, lns []net.Listener) {
+	var wg sync.WaitGroup
+	for _, ln := range lns {
+		wg.Add(1)
+		go func(ln net.Listener) {
+			defer wg.Done()
+			var err error
+			if Options.TLSCert != "" {
+				err = srv.ServeTLS(ln, Options.TLSCert, Options.TLSKey)
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				// 証明書を読めないなど、起動できなければ終了する
+				fatal(err)
+			} else {
+				logger.Noticef("server closed")
+			}
+		}(ln)
+	}
+	wg.Wait()
+}
+
+func runSignalHandler(srv *http.Server, handler *httpHandler) chan struct{} {
 	done := make(chan struct{}, 1)
 	sigCh := make(chan os.Signal, 10)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGHUP)
 
 	go func() {
 		sig := <-sigCh
+		for sig == syscall.SIGUSR1 || sig == syscall.SIGHUP {
+			if sig == syscall.SIGUSR1 {
+				// サーバを止めずに状態をログに出す
+				handler.logStatus()
+			} else if Options.ReadOnlyFile != "" {
+				// ファイルの有無で決めるので、何度受け取っても同じ状態になる
+				readonly := readOnlyFileExists()
+				handler.setReadOnly(readonly)
+				logger.Noticef("readonly %v", readonly)
+			} else {
+				// ログのローテーションなどで送られても書き込みは止めない
+				logger.Noticef("ignored %v without -readonly-file", sig)
+			}
+			sig = <-sigCh
+		}
 		signal.Stop(sigCh)
 		close(sigCh)
 
 		logger.Noticef("signal %v", sig)
 
+		// keep-aliveをやめてロードバランサに接続を張り替えさせる
+		// その間もリクエストは処理する
+		if Options.DrainGrace > 0 {
+			srv.SetKeepAlivesEnabled(false)
+			logger.Noticef("wait %v before shutdown", Options.DrainGrace)
+			time.Sleep(Options.DrainGrace)
+		}
+
 		// 先にサーバ側を終了し、新規のリクエストを止める
-		ln.Close()
+		// 処理中のリクエストはshutdown-timeoutまで完了を待つ
+		ctx, cancel := context.WithTimeout(context.Background(), Options.ShutdownTimeout)
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Warnf("shutdown: %v", err)
+		}
+		cancel()
 
 		// ワーカーを停止する
-		handler.Close()
+		if err := handler.Close(); err != nil {
+			logger.Errorf("%v", err)
+		}
+
+		// 残っているspanを送る
+		ctx, cancel = context.WithTimeout(context.Background(), Options.ShutdownTimeout)
+		shutdownTracing(ctx)
+		cancel()
 
 		// 完了
 		close(done)
@@ -135,24 +603,125 @@ func runSignalHandler(ln net.Listener, handler *httpHandler) chan struct{} {
 	return done
 }
 
-func listen() (net.Listener, error) {
-	if Options.FD != 0 {
-		return listenFileDescriptor(Options.FD)
+// listen opens the listeners. A descriptor from systemd or -fd is used
+// alone. Otherwise the TCP listeners of -port and the unix socket of
+// -socket can be used together.
+func listen() ([]net.Listener, error) {
+	if fd, ok := systemdListenFD(); ok {
+		// 子プロセスに引き継がないようにする
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		ln, err := listenFileDescriptor(fd)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	} else if Options.FD != 0 {
+		ln, err := listenFileDescriptor(Options.FD)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	lns := make([]net.Listener, 0)
+	if Options.Port != 0 && Options.ReusePort > 0 {
+		reuse, err := listenReusePort(Options.Bind, Options.Port, Options.ReusePort)
+		if err != nil {
+			return nil, err
+		}
+		lns = append(lns, reuse...)
 	} else if Options.Port != 0 {
-		return listenTCP(Options.Port)
+		ln, err := listenTCP(Options.Bind, Options.Port)
+		if err != nil {
+			return nil, err
+		}
+		lns = append(lns, ln)
 	}
-	return nil, fmt.Errorf("no listener")
+	if Options.Socket != "" {
+		ln, err := listenUnix(Options.Socket)
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	if len(lns) == 0 {
+		return nil, fmt.Errorf("no listener")
+	}
+	return lns, nil
 }
 
-func listenTCP(port int) (net.Listener, error) {
-	addr := fmt.Sprintf(":%d", port)
-	logger.Infof("listenTCP %d", port)
+// listenUnix listens on the unix socket. A socket file left by a previous
+// process is removed first.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	logger.Infof("listenUnix %s", path)
+	return net.Listen("unix", path)
+}
+
+func listenTCP(host string, port int) (net.Listener, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	logger.Infof("listenTCP %s", addr)
 	return net.Listen("tcp", addr)
 }
 
+// listenReusePort opens n listeners on the same address with SO_REUSEPORT
+// so that the kernel balances connections between their accept loops.
+func listenReusePort(host string, port int, n int) ([]net.Listener, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = setReusePort(fd)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+
+	lns := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		ln, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range lns {
+				l.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+	logger.Infof("listenReusePort %s x%d", addr, n)
+	return lns, nil
+}
+
 func listenFileDescriptor(fd uint) (net.Listener, error) {
 	file := os.NewFile(uintptr(fd), "listen socket")
 	defer file.Close()
 	logger.Infof("listenFileDescriptor %v", file)
 	return net.FileListener(file)
 }
+
+// systemdのsocket activationで渡される最初のファイルディスクリプタ
+const systemdListenFdsStart = 3
+
+// systemdListenFD returns the descriptor passed by systemd socket activation.
+func systemdListenFD() (uint, bool) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return 0, false
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return systemdListenFdsStart, true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/najeira/goutils/nlog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// discardLogger drops the logs of the tests.
+type discardLogger struct {
+	nlog.Logger
+}
+
+func (discardLogger) Debugf(format string, args ...interface{})    {}
+func (discardLogger) Infof(format string, args ...interface{})     {}
+func (discardLogger) Noticef(format string, args ...interface{})   {}
+func (discardLogger) Warnf(format string, args ...interface{})     {}
+func (discardLogger) Errorf(format string, args ...interface{})    {}
+func (discardLogger) Criticalf(format string, args ...interface{}) {}
+
+func TestMain(m *testing.M) {
+	logger = discardLogger{}
+	os.Exit(m.Run())
+}
+
+// fakeWriter is a bigqueryWriter that keeps the rows in memory. The errors
+// in connectErrs and addErrs are returned in order by the first calls.
+type fakeWriter struct {
+	mu          sync.Mutex
+	rows        []map[string]interface{}
+	connects    int
+	closes      int
+	connectErrs []error
+	addErrs     []error
+	closeErr    error
+
+	// Connectにかかる時間
+	connectDelay time.Duration
+
+	// nilでなければ、Addは閉じられるまで待つ
+	addBlock chan struct{}
+}
+
+func (w *fakeWriter) Connect(email string, pem []byte) error {
+	time.Sleep(w.connectDelay)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.connects++
+	if len(w.connectErrs) > 0 {
+		err := w.connectErrs[0]
+		w.connectErrs = w.connectErrs[1:]
+		return err
+	}
+	return nil
+}
+
+func (w *fakeWriter) Add(insertId string, row map[string]interface{}) error {
+	if w.addBlock != nil {
+		<-w.addBlock
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.addErrs) > 0 {
+		err := w.addErrs[0]
+		w.addErrs = w.addErrs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	w.rows = append(w.rows, row)
+	return nil
+}
+
+func (w *fakeWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closes++
+	return w.closeErr
+}
+
+func TestReadTimeoutReturns408(t *testing.T) {
+	defer func(d time.Duration) { Options.ReadTimeout = d }(Options.ReadTimeout)
+	Options.ReadTimeout = 100 * time.Millisecond
+
+	h := newHttpHandler()
+	h.setReady(true)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(h)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 本文の途中で送信を止める
+	fmt.Fprintf(conn, "POST /p/d/t HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n{\"a\": ")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("status = %d, want 408", resp.StatusCode)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// metrics holds the counters exported by /metrics. They are updated with
+// atomic operations, and also sent to -statsd-addr.
+type metrics struct {
+	writersCreated int64
+	writersClosed  int64
+
+	// ?async=1で失敗したリクエストと行
+	asyncFailures   int64
+	asyncRowsFailed int64
+
+	// X-Priorityにより断ったリクエスト
+	requestsShed int64
+}
+
+func (m *metrics) writerCreated() {
+	atomic.AddInt64(&m.writersCreated, 1)
+	statsd.count("writers_created", 1)
+}
+
+func (m *metrics) writerClosed() {
+	atomic.AddInt64(&m.writersClosed, 1)
+	statsd.count("writers_closed", 1)
+}
+
+func (m *metrics) asyncFailed() {
+	atomic.AddInt64(&m.asyncFailures, 1)
+	statsd.count("async_failures", 1)
+}
+
+func (m *metrics) asyncRowFailed(n int) {
+	atomic.AddInt64(&m.asyncRowsFailed, int64(n))
+	statsd.count("async_rows_failed", int64(n))
+}
+
+func (m *metrics) requestShed() {
+	atomic.AddInt64(&m.requestsShed, 1)
+	statsd.count("requests_shed", 1)
+}
+
+// metricLabels formats the labels of a sample from name and value pairs.
+// Every sample has the instance label, and empty values are omitted.
+func metricLabels(pairs ...string) string {
+	pairs = append([]string{"instance", Options.InstanceId}, pairs...)
+	var buf bytes.Buffer
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%s=%q", pairs[i], pairs[i+1])
+	}
+	if buf.Len() == 0 {
+		return ""
+	}
+	return "{" + buf.String() + "}"
+}
+
+func writeMetric(buf *bytes.Buffer, name, kind, help string, value interface{}) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(buf, "%s%s %v\n", name, metricLabels(), value)
+}
+
+// writeTableMetric writes a metric with a sample for each table.
+func writeTableMetric(buf *bytes.Buffer, name, kind, help string, tables []tableStatus, value func(tableStatus) int64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, kind)
+	for _, t := range tables {
+		labels := metricLabels("table", t.Table, "credential", t.Credential)
+		fmt.Fprintf(buf, "%s%s %d\n", name, labels, value(t))
+	}
+}
+
+// serveMetrics writes the metrics in the Prometheus text format.
+func (h *httpHandler) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	writers := len(h.writers)
+	h.mu.Unlock()
+
+	var buf bytes.Buffer
+	writeMetric(&buf, "bqproxy_writers_open", "gauge", "Number of open writers.", writers)
+	writeMetric(&buf, "bqproxy_writers_created_total", "counter", "Number of writers created.",
+		atomic.LoadInt64(&h.metrics.writersCreated))
+	writeMetric(&buf, "bqproxy_writers_closed_total", "counter", "Number of writers closed or evicted.",
+		atomic.LoadInt64(&h.metrics.writersClosed))
+	writeMetric(&buf, "bqproxy_async_failures_total", "counter", "Number of async requests failed as a whole.",
+		atomic.LoadInt64(&h.metrics.asyncFailures))
+	writeMetric(&buf, "bqproxy_async_rows_failed_total", "counter", "Number of rows failed in async requests.",
+		atomic.LoadInt64(&h.metrics.asyncRowsFailed))
+	writeMetric(&buf, "bqproxy_requests_shed_total", "counter", "Number of requests rejected by load shedding.",
+		atomic.LoadInt64(&h.metrics.requestsShed))
+
+	tables := h.tableStatuses()
+	writeTableMetric(&buf, "bqproxy_table_adds_in_flight", "gauge", "Number of rows being added to the writer of the table.",
+		tables, func(t tableStatus) int64 { return t.InFlight })
+	writeTableMetric(&buf, "bqproxy_table_rows_total", "counter", "Number of rows added to the writer of the table.",
+		tables, func(t tableStatus) int64 { return t.Rows })
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
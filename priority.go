@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The priority of a request in the X-Priority header.
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+)
+
+func requestPriority(r *http.Request) (int, error) {
+	value := r.Header.Get("X-Priority")
+	switch strings.ToLower(value) {
+	case "low":
+		return priorityLow, nil
+	case "", "normal":
+		return priorityNormal, nil
+	case "high":
+		return priorityHigh, nil
+	}
+	return 0, fmt.Errorf("invalid X-Priority %s", value)
+}
+
+// shouldShed reports whether a request of the priority is rejected while
+// the global write semaphore is busy. With -shed-threshold, low priority
+// requests are shed when the batches in flight reach the fraction of
+// -global-write-concurrency, and normal ones when it is full. High
+// priority requests are always admitted and wait for the semaphore.
+func shouldShed(priority int) bool {
+	if Options.ShedThreshold <= 0 || writeSem == nil {
+		return false
+	}
+	inFlight := float64(len(writeSem))
+	switch priority {
+	case priorityLow:
+		return inFlight >= Options.ShedThreshold*float64(cap(writeSem))
+	case priorityNormal:
+		return inFlight >= float64(cap(writeSem))
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// recentError is an error of a row kept for /admin/errors.
+type recentError struct {
+	Time    int64  `json:"time"`
+	Table   string `json:"table"`
+	Index   int    `json:"index"`
+	Message string `json:"message"`
+}
+
+// recentErrors is a ring buffer of the last -recent-errors row errors.
+type recentErrors struct {
+	mu     sync.Mutex
+	errors []recentError
+	next   int
+	full   bool
+}
+
+func (b *recentErrors) add(table string, errors []*writeError) {
+	if Options.RecentErrors <= 0 || len(errors) == 0 {
+		return
+	}
+	now := time.Now().Unix()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.errors == nil {
+		b.errors = make([]recentError, Options.RecentErrors)
+	}
+	for _, we := range errors {
+		b.errors[b.next] = recentError{
+			Time:    now,
+			Table:   table,
+			Index:   we.Index,
+			Message: we.Error.Error(),
+		}
+		b.next++
+		if b.next == len(b.errors) {
+			b.next = 0
+			b.full = true
+		}
+	}
+}
+
+// list returns the errors from the oldest.
+func (b *recentErrors) list() []recentError {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]recentError{}, b.errors[:b.next]...)
+	}
+	list := append([]recentError{}, b.errors[b.next:]...)
+	return append(list, b.errors[:b.next]...)
+}
+
+func (h *httpHandler) serveRecentErrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		h.methodNotAllowed(w, r, "method not allowed")
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{"errors": h.recentErrors.list()})
+	if err != nil {
+		h.internalError(w, r, err.Error())
+		return
+	}
+	h.ok(w, body)
+}
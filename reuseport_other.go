@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+)
+
+func setReusePort(fd uintptr) error {
+	return fmt.Errorf("reuseport is not supported on this platform")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+)
+
+// 行ごとに書き込み先を指定するためのフィールド
+// 書き込む前に行から取り除かれる
+const (
+	routeDatasetField = "_dataset"
+	routeTableField   = "_table"
+)
+
+var errDatasetNotAllowed = fmt.Errorf("dataset is not allowed")
+
+type destination struct {
+	dataset string
+	table   string
+}
+
+// routeRows groups the rows by the destination given in their routing
+// fields. Rows without the fields go to the dataset and table of the path.
+// A routed name is checked like the segments of the path, and a row with
+// an invalid one fails without creating a writer.
+func routeRows(rows []*parsedRow, dataset, table string) (map[destination][]*parsedRow, []*writeError) {
+	groups := make(map[destination][]*parsedRow)
+	errors := make([]*writeError, 0)
+	for _, row := range rows {
+		dest := destination{dataset: dataset, table: table}
+		if err := routeField(row, routeDatasetField, &dest.dataset); err != nil {
+			errors = append(errors, &writeError{Index: row.index, Error: err})
+			continue
+		}
+		if err := routeField(row, routeTableField, &dest.table); err != nil {
+			errors = append(errors, &writeError{Index: row.index, Error: err})
+			continue
+		}
+		// パスで指定されたテーブルと同じ検証をする
+		if err := checkPartitionDecorator(dest.table); err != nil {
+			errors = append(errors, &writeError{Index: row.index, Error: err})
+			continue
+		}
+		groups[dest] = append(groups[dest], row)
+	}
+	return groups, errors
+}
+
+func routeField(row *parsedRow, field string, dst *string) error {
+	value, ok := row.value[field]
+	if !ok {
+		return nil
+	}
+	delete(row.value, field)
+	s, ok := value.(string)
+	if !ok || s == "" {
+		return fmt.Errorf("%s must be a non-empty string", field)
+	} else if err := checkName(field, s); err != nil {
+		return err
+	}
+	*dst = s
+	return nil
+}
+
+// processRoutedBatch is ProcessBatch for requests with routing fields.
+func (h *httpHandler) processRoutedBatch(project, dataset, table string, body []byte, opts *insertOptions) (*response, error) {
+	lines, err := splitLines(body, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, parseErrors := parseLines(lines)
+	errors := h.sendRoutedRows(project, dataset, table, rows, opts)
+	return buildResponse(lines, parseErrors, errors), nil
+}
+
+// sendRoutedRows writes each group of rows with the writer of its
+// destination. A writer that can not be created fails only its own rows.
+func (h *httpHandler) sendRoutedRows(project, dataset, table string, rows []*parsedRow, opts *insertOptions) []*writeError {
+	groups, errors := routeRows(rows, dataset, table)
+	for dest, rows := range groups {
+		if !isDatasetAllowed(dest.dataset) {
+			for _, row := range rows {
+				errors = append(errors, &writeError{Index: row.index, Error: errDatasetNotAllowed})
+			}
+			continue
+		}
+
+		writer, err := h.getBigqueryWriter(opts.credential, project, dest.dataset, dest.table)
+		if err != nil {
+			for _, row := range rows {
+				errors = append(errors, &writeError{Index: row.index, Error: err})
+			}
+			continue
+		}
+
+		if !writer.breaker.allow() {
+			for _, row := range rows {
+				errors = append(errors, &writeError{Index: row.index, Error: errBreakerOpen})
+			}
+			writer.release()
+			continue
+		}
+
+		destOpts := *opts
+		destOpts.table = project + "/" + dest.dataset + "/" + dest.table
+		destOpts.sample = Options.SampleRate > 0 && destOpts.table == Options.SampleTable
+		errors = append(errors, sendLines(writer, rows, &destOpts)...)
+		writer.release()
+	}
+	return errors
+}
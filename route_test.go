@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRouteRowsValidatesNames(t *testing.T) {
+	body := []string{
+		`{"_table": "x/y$abc"}`,
+		`{"_dataset": "a|b", "_table": "c"}`,
+		`{"_dataset": "a", "_table": "b|c"}`,
+		`{"_table": "t$abc"}`,
+		`{"_table": "t$20240101"}`,
+		`{"_dataset": "other"}`,
+	}
+	rows, parseErrors := parseLines(body)
+	if len(parseErrors) != 0 {
+		t.Fatalf("parse errors = %v", parseErrors)
+	}
+
+	groups, errors := routeRows(rows, "d", "t")
+	if len(errors) != 4 {
+		t.Fatalf("errors = %v, want one for each of the first 4 rows", errors)
+	}
+	for i, e := range errors {
+		if e.Index != i {
+			t.Errorf("error %d is for row %d", i, e.Index)
+		}
+	}
+
+	want := map[destination]int{
+		{dataset: "d", table: "t$20240101"}: 4,
+		{dataset: "other", table: "t"}:      5,
+	}
+	if len(groups) != len(want) {
+		t.Fatalf("groups = %v, want %v", groups, want)
+	}
+	for dest, index := range want {
+		if rows := groups[dest]; len(rows) != 1 || rows[0].index != index {
+			t.Errorf("group %v = %v, want row %d", dest, rows, index)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// tableSchema maps a top-level field name to its JSON type.
+type tableSchema map[string]string
+
+// jsonType returns the JSON type name of a value decoded by encoding/json.
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case json.Number, float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return ""
+}
+
+// observe adds the fields of the row to the schema being inferred.
+// null values do not determine a type.
+func (s tableSchema) observe(row map[string]interface{}) {
+	for key, value := range row {
+		if t := jsonType(value); t != "" {
+			if _, ok := s[key]; !ok {
+				s[key] = t
+			}
+		}
+	}
+}
+
+// validate checks that the fields known to the schema have the same type.
+// Fields the schema has not seen and null values are allowed.
+func (s tableSchema) validate(row map[string]interface{}) error {
+	for key, value := range row {
+		expected, ok := s[key]
+		if !ok {
+			continue
+		}
+		if t := jsonType(value); t != "" && t != expected {
+			return fmt.Errorf("field %s must be %s, not %s", key, expected, t)
+		}
+	}
+	return nil
+}
+
+// schemaCache holds the schemas inferred from the first successful batch
+// of each table.
+type schemaCache struct {
+	mu      sync.RWMutex
+	schemas map[string]tableSchema
+}
+
+var schemas = &schemaCache{schemas: make(map[string]tableSchema)}
+
+func (c *schemaCache) get(table string) tableSchema {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.schemas[table]
+}
+
+// learn stores the inferred schema unless the table has one.
+func (c *schemaCache) learn(table string, schema tableSchema) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.schemas[table]; !ok {
+		c.schemas[table] = schema
+	}
+}
+
+func (c *schemaCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.schemas = make(map[string]tableSchema)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// isSLORequest reports whether the client asked for a 503 after
+// -slo-deadline instead of waiting for the whole write.
+func isSLORequest(r *http.Request) bool {
+	return Options.SLODeadline > 0 && r.Header.Get("X-SLO-Deadline") == "1"
+}
+
+// processWithDeadline runs process and waits for it up to -slo-deadline.
+// When the deadline passes first, it returns false and the write goes on
+// in the background like an ?async=1 write. The reservations of body are
+// released when the write has finished, not when the handler returns.
+func (h *httpHandler) processWithDeadline(table string, body *requestBody, process func() (*response, error)) (*response, error, bool) {
+	type outcome struct {
+		result *response
+		err    error
+	}
+	done := make(chan outcome, 1)
+
+	// シャットダウンでは書き込みの完了を待つ
+	h.async.Add(1)
+	go func() {
+		defer h.async.Done()
+		result, err := process()
+		done <- outcome{result, err}
+	}()
+
+	timer := time.NewTimer(Options.SLODeadline)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		h.releaseBody(body)
+		return o.result, o.err, true
+	case <-timer.C:
+	}
+
+	h.async.Add(1)
+	go func() {
+		defer h.async.Done()
+		defer h.releaseBody(body)
+		o := <-done
+		h.finishAsync(table, o.result, o.err)
+	}()
+	return nil, nil, false
+}
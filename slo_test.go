@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSLODeadlineKeepsReservationUntilWritten(t *testing.T) {
+	writer := &fakeWriter{addBlock: make(chan struct{})}
+	defer func(f func(string, string, string) bigqueryWriter) { newWriter = f }(newWriter)
+	newWriter = func(project, dataset, table string) bigqueryWriter { return writer }
+	defer func(d time.Duration) { Options.SLODeadline = d }(Options.SLODeadline)
+	Options.SLODeadline = 10 * time.Millisecond
+
+	h := newHttpHandler()
+	h.setReady(true)
+	body := `{"a": 1}` + "\n" + `{"a": 2}` + "\n"
+	req := httptest.NewRequest("POST", "/p/d/t", strings.NewReader(body))
+	req.Header.Set("X-SLO-Deadline", "1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", w.Code)
+	}
+
+	// 書き込みが終わるまでは本文を保持している
+	if n := atomic.LoadInt64(&h.bufferedBytes); n != int64(len(body)) {
+		t.Errorf("%d bytes buffered during the late write, want %d", n, len(body))
+	}
+	if n := atomic.LoadInt64(&h.queuedRows); n != 2 {
+		t.Errorf("%d rows queued during the late write, want 2", n)
+	}
+
+	close(writer.addBlock)
+	h.async.Wait()
+	if len(writer.rows) != 2 {
+		t.Errorf("%d rows written, want 2", len(writer.rows))
+	}
+	if n := atomic.LoadInt64(&h.bufferedBytes); n != 0 {
+		t.Errorf("%d bytes still buffered after the write", n)
+	}
+	if n := atomic.LoadInt64(&h.queuedRows); n != 0 {
+		t.Errorf("%d rows still queued after the write", n)
+	}
+}
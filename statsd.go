@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// statsd sends the metrics to -statsd-addr. nil when the flag is empty.
+var statsd *statsdClient
+
+// statsdClient writes StatsD packets over UDP. A lost packet only loses a
+// sample, so the write errors are ignored.
+type statsdClient struct {
+	conn net.Conn
+}
+
+func initStatsd(addr string) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	statsd = &statsdClient{conn: conn}
+	return nil
+}
+
+func (s *statsdClient) count(name string, n int64) {
+	if s == nil {
+		return
+	}
+	s.send(fmt.Sprintf("bqproxy.%s:%d|c", name, n))
+}
+
+func (s *statsdClient) timing(name string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.send(fmt.Sprintf("bqproxy.%s:%d|ms", name, d/time.Millisecond))
+}
+
+func (s *statsdClient) send(packet string) {
+	if _, err := s.conn.Write([]byte(packet)); err != nil {
+		logger.Debugf("statsd: %v", err)
+	}
+}
+
+// statsdRequest sends the rows, the failed rows and the latency of an
+// insert request.
+func statsdRequest(start time.Time, result *response) {
+	if statsd == nil {
+		return
+	}
+	statsd.count("requests", 1)
+	statsd.timing("request_duration", time.Since(start))
+	if result != nil {
+		statsd.count("rows", int64(result.rows))
+		statsd.count("rows_failed", int64(len(result.Errors)))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReadMemStatsはstop-the-worldを伴うので一定時間キャッシュする
+const memStatsInterval = time.Second * 10
+
+type memStatsCache struct {
+	mu      sync.Mutex
+	stats   runtime.MemStats
+	updated time.Time
+}
+
+func (c *memStatsCache) get() (runtime.MemStats, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.updated) >= memStatsInterval {
+		runtime.ReadMemStats(&c.stats)
+		c.updated = time.Now()
+	}
+	return c.stats, c.updated
+}
+
+type runtimeStatus struct {
+	Goroutines     int    `json:"goroutines"`
+	HeapAlloc      uint64 `json:"heap_alloc"`
+	HeapObjects    uint64 `json:"heap_objects"`
+	NumGC          uint32 `json:"num_gc"`
+	PauseTotalNs   uint64 `json:"gc_pause_total_ns"`
+	LastGC         int64  `json:"last_gc"`
+	MemStatsUpdate int64  `json:"mem_stats_updated"`
+}
+
+// tableStatus is the activity of the writer of a table. The rows buffered
+// inside the writer are not visible to the proxy, so it reports the rows
+// added to the writer instead.
+type tableStatus struct {
+	Table      string `json:"table"`
+	Credential string `json:"credential,omitempty"`
+	InFlight   int64  `json:"in_flight"`
+	Rows       int64  `json:"rows"`
+}
+
+// tableStatuses returns the status of the open writers sorted by table.
+func (h *httpHandler) tableStatuses() []tableStatus {
+	h.mu.Lock()
+	tables := make([]tableStatus, 0, len(h.writers))
+	for _, entry := range h.writers {
+		tables = append(tables, tableStatus{
+			Table:      entry.table,
+			Credential: entry.credential,
+			InFlight:   atomic.LoadInt64(&entry.inFlight),
+			Rows:       atomic.LoadInt64(&entry.rows),
+		})
+	}
+	h.mu.Unlock()
+
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].Table != tables[j].Table {
+			return tables[i].Table < tables[j].Table
+		}
+		return tables[i].Credential < tables[j].Credential
+	})
+	return tables
+}
+
+type status struct {
+	Instance       string        `json:"instance,omitempty"`
+	Writers        int           `json:"writers"`
+	WritersCreated int64         `json:"writers_created"`
+	WritersClosed  int64         `json:"writers_closed"`
+	BufferedBytes  int64         `json:"buffered_bytes"`
+	QueuedRows     int64         `json:"queued_rows"`
+	Tables         []tableStatus `json:"tables"`
+	Runtime        runtimeStatus `json:"runtime"`
+}
+
+func (h *httpHandler) status() *status {
+	h.mu.Lock()
+	writers := len(h.writers)
+	h.mu.Unlock()
+
+	mem, updated := h.memStats.get()
+	return &status{
+		Instance:       Options.InstanceId,
+		Writers:        writers,
+		WritersCreated: atomic.LoadInt64(&h.metrics.writersCreated),
+		WritersClosed:  atomic.LoadInt64(&h.metrics.writersClosed),
+		BufferedBytes:  atomic.LoadInt64(&h.bufferedBytes),
+		QueuedRows:     atomic.LoadInt64(&h.queuedRows),
+		Tables:         h.tableStatuses(),
+		Runtime: runtimeStatus{
+			Goroutines:     runtime.NumGoroutine(),
+			HeapAlloc:      mem.HeapAlloc,
+			HeapObjects:    mem.HeapObjects,
+			NumGC:          mem.NumGC,
+			PauseTotalNs:   mem.PauseTotalNs,
+			LastGC:         int64(mem.LastGC / uint64(time.Second)),
+			MemStatsUpdate: updated.Unix(),
+		},
+	}
+}
+
+func (h *httpHandler) serveStatus(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(h.status())
+	if err != nil {
+		h.internalError(w, r, err.Error())
+		return
+	}
+	h.ok(w, body)
+}
+
+// logStatus writes the same information as the status endpoint to the log.
+func (h *httpHandler) logStatus() {
+	body, err := json.Marshal(h.status())
+	if err != nil {
+		logger.Errorf("status: %v", err)
+		return
+	}
+	logger.Warnf("status: %s", body)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// progressStream writes the progress of a batch as a stream of JSON
+// objects, one line per chunk of rows. The last line is the response with
+// the aggregated errors, so clients can tell it by its "errors" field.
+type progressStream struct {
+	w       http.ResponseWriter
+	every   int
+	started bool
+
+	Processed int `json:"processed"`
+	Errors    int `json:"errors"`
+}
+
+func newProgressStream(w http.ResponseWriter, every int) *progressStream {
+	if every <= 0 {
+		every = 1
+	}
+	return &progressStream{w: w, every: every}
+}
+
+// isStreamRequest reports whether the client asked for a progress stream.
+func isStreamRequest(r *http.Request) bool {
+	return r.URL.Query().Get("stream") == "1"
+}
+
+// row records a row that has been written, and writes the progress at
+// the end of each chunk.
+func (s *progressStream) row(err error) {
+	s.Processed++
+	if err != nil {
+		s.Errors++
+	}
+	if s.Processed%s.every == 0 {
+		s.write(s)
+	}
+}
+
+func (s *progressStream) write(v interface{}) {
+	if !s.started {
+		s.w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+	body, err := json.Marshal(v)
+	if err != nil {
+		logger.Warnf("stream: %v", err)
+		return
+	}
+	s.w.Write(append(body, '\n'))
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
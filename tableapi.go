@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// schemaField is a field of a BigQuery table schema.
+type schemaField struct {
+	Name        string         `json:"name"`
+	Type        string         `json:"type"`
+	Mode        string         `json:"mode,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Fields      []*schemaField `json:"fields,omitempty"`
+}
+
+type apiTableSchema struct {
+	Fields []*schemaField `json:"fields"`
+}
+
+type apiTable struct {
+	TableReference struct {
+		ProjectID string `json:"projectId"`
+		DatasetID string `json:"datasetId"`
+		TableID   string `json:"tableId"`
+	} `json:"tableReference"`
+	Schema *apiTableSchema `json:"schema,omitempty"`
+}
+
+// serveSchema handles the table schema endpoints.
+//
+//	GET /schema/{project}/{dataset}/{table} returns the schema the rows
+//	                                        are validated against
+//	PUT /schema/{project}/{dataset}/{table} creates the table, or adds
+//	                                        the new fields to it
+func (h *httpHandler) serveSchema(w http.ResponseWriter, r *http.Request) {
+	project, dataset, table, err := splitTablePath(strings.TrimPrefix(r.URL.Path, "/schema/"))
+	if err != nil {
+		h.badRequest(w, r, "invalid uri")
+		return
+	} else if r.Method != "GET" && r.Method != "PUT" {
+		h.methodNotAllowed(w, r, "method not allowed")
+		return
+	}
+
+	switch authorizeProject(r, project) {
+	case http.StatusUnauthorized:
+		h.unauthorized(w, r, "unauthorized")
+		return
+	case http.StatusForbidden:
+		h.forbidden(w, r, "project is not allowed")
+		return
+	}
+
+	if r.Method == "GET" {
+		h.serveValidationSchema(w, r, project+"/"+dataset+"/"+table)
+		return
+	} else if !Options.EnableSchema || h.api == nil {
+		h.notFound(w, r, "schema endpoints are disabled")
+		return
+	}
+
+	if !isDatasetAllowed(dataset) {
+		h.forbidden(w, r, errDatasetNotAllowed.Error())
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	}
+	schema, err := parseTableSchema(body)
+	if err != nil {
+		h.badRequest(w, r, err.Error())
+		return
+	}
+
+	status, err := h.putTableSchema(project, dataset, table, schema)
+	if err == errIncompatibleSchema {
+		h.errorResponse(w, r, http.StatusConflict, err.Error())
+		return
+	} else if err != nil {
+		h.internalError(w, r, err.Error())
+		return
+	}
+
+	// 次の書き込みから新しいスキーマで検証する
+	schemas.invalidate()
+
+	logger.Noticef("schema %s/%s/%s: %s", project, dataset, table, status)
+	h.ok(w, []byte(fmt.Sprintf(`{"status": %q}`, status)))
+}
+
+// serveValidationSchema returns the schema inferred with -infer-schema,
+// a map of the top-level fields to their JSON types.
+func (h *httpHandler) serveValidationSchema(w http.ResponseWriter, r *http.Request, table string) {
+	schema := schemas.get(table)
+	if schema == nil {
+		h.notFound(w, r, "schema not found")
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{"table": table, "fields": schema})
+	if err != nil {
+		h.internalError(w, r, err.Error())
+		return
+	}
+	h.ok(w, body)
+}
+
+// parseTableSchema parses a schema as the "schema" of a table resource,
+// or as an array of fields like the schema files of the bq command.
+func parseTableSchema(body []byte) (*apiTableSchema, error) {
+	schema := &apiTableSchema{}
+	if isJSONArrayBytes(body) {
+		if err := json.Unmarshal(body, &schema.Fields); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(body, schema); err != nil {
+		return nil, err
+	}
+	if len(schema.Fields) == 0 {
+		return nil, fmt.Errorf("schema has no fields")
+	} else if err := checkSchemaFields(schema.Fields); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+func checkSchemaFields(fields []*schemaField) error {
+	for _, f := range fields {
+		if f == nil || f.Name == "" || f.Type == "" {
+			return fmt.Errorf("schema field requires name and type")
+		} else if err := checkSchemaFields(f.Fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isJSONArrayBytes(body []byte) bool {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+var errIncompatibleSchema = fmt.Errorf("table exists with an incompatible schema")
+
+// putTableSchema creates the table with the schema, or patches the table
+// when the schema only adds fields to the current one. It returns
+// "created", "updated" or "unchanged".
+func (h *httpHandler) putTableSchema(project, dataset, table string, schema *apiTableSchema) (string, error) {
+	path := "/projects/" + url.PathEscape(project) + "/datasets/" + url.PathEscape(dataset) + "/tables"
+
+	var current apiTable
+	err := h.api.call("GET", path+"/"+url.PathEscape(table), nil, &current)
+	if e, ok := err.(*apiError); ok && e.StatusCode == http.StatusNotFound {
+		t := &apiTable{Schema: schema}
+		t.TableReference.ProjectID = project
+		t.TableReference.DatasetID = dataset
+		t.TableReference.TableID = table
+		if err := h.api.call("POST", path, t, nil); err != nil {
+			return "", err
+		}
+		return "created", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	var fields []*schemaField
+	if current.Schema != nil {
+		fields = current.Schema.Fields
+	}
+	added, err := compatibleFields(fields, schema.Fields)
+	if err != nil {
+		return "", err
+	} else if !added {
+		return "unchanged", nil
+	}
+
+	// 列の追加だけならテーブルを作り直さずに更新できる
+	patch := &apiTable{Schema: schema}
+	patch.TableReference = current.TableReference
+	if err := h.api.call("PATCH", path+"/"+url.PathEscape(table), patch, nil); err != nil {
+		return "", err
+	}
+	return "updated", nil
+}
+
+// compatibleFields checks that next keeps every field of current with the
+// same type and mode, and that the added fields are not REQUIRED, which is
+// the only change BigQuery allows to an existing table. It reports whether
+// next adds any field.
+func compatibleFields(current, next []*schemaField) (bool, error) {
+	byName := make(map[string]*schemaField, len(next))
+	for _, f := range next {
+		byName[strings.ToLower(f.Name)] = f
+	}
+
+	added := len(next) > len(current)
+	for _, cur := range current {
+		f, ok := byName[strings.ToLower(cur.Name)]
+		if !ok {
+			return false, errIncompatibleSchema
+		} else if fieldType(f) != fieldType(cur) || fieldMode(f) != fieldMode(cur) {
+			return false, errIncompatibleSchema
+		}
+		sub, err := compatibleFields(cur.Fields, f.Fields)
+		if err != nil {
+			return false, err
+		}
+		added = added || sub
+		delete(byName, strings.ToLower(cur.Name))
+	}
+	for _, f := range byName {
+		if fieldMode(f) == "REQUIRED" {
+			return false, errIncompatibleSchema
+		}
+	}
+	return added, nil
+}
+
+// 標準SQLの型名と、tables APIが返すレガシーSQLの型名
+var legacyFieldTypes = map[string]string{
+	"INT64":      "INTEGER",
+	"FLOAT64":    "FLOAT",
+	"BOOL":       "BOOLEAN",
+	"STRUCT":     "RECORD",
+	"DECIMAL":    "NUMERIC",
+	"BIGDECIMAL": "BIGNUMERIC",
+}
+
+// fieldType returns the type of the field by its legacy SQL name, so that
+// INT64 and INTEGER, for example, compare equal.
+func fieldType(f *schemaField) string {
+	t := strings.ToUpper(f.Type)
+	if legacy, ok := legacyFieldTypes[t]; ok {
+		return legacy
+	}
+	return t
+}
+
+func fieldMode(f *schemaField) string {
+	if f.Mode == "" {
+		return "NULLABLE"
+	}
+	return strings.ToUpper(f.Mode)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCompatibleFieldsTypeAliases(t *testing.T) {
+	tests := []struct {
+		current, next string
+		compatible    bool
+	}{
+		{"INTEGER", "INT64", true},
+		{"INT64", "INTEGER", true},
+		{"FLOAT", "FLOAT64", true},
+		{"FLOAT64", "FLOAT", true},
+		{"BOOLEAN", "BOOL", true},
+		{"BOOL", "BOOLEAN", true},
+		{"RECORD", "STRUCT", true},
+		{"STRUCT", "RECORD", true},
+		{"NUMERIC", "DECIMAL", true},
+		{"BIGNUMERIC", "BIGDECIMAL", true},
+		{"STRING", "string", true},
+		{"INTEGER", "FLOAT64", false},
+		{"NUMERIC", "BIGNUMERIC", false},
+	}
+	for _, tt := range tests {
+		current := []*schemaField{{Name: "a", Type: tt.current}}
+		next := []*schemaField{{Name: "a", Type: tt.next}}
+		added, err := compatibleFields(current, next)
+		if tt.compatible && (err != nil || added) {
+			t.Errorf("%s to %s: added = %v, err = %v, want unchanged", tt.current, tt.next, added, err)
+		} else if !tt.compatible && err != errIncompatibleSchema {
+			t.Errorf("%s to %s: err = %v, want incompatible", tt.current, tt.next, err)
+		}
+	}
+}
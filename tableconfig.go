@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// tableConfig is the per-table configuration in the -table-config file,
+// a JSON object keyed by "project/dataset/table".
+type tableConfig struct {
+	// InsertId is the insertId strategy: "random" (default), "hash" for a
+	// hash of the row, "field:<name>" to use a field of the row, or the
+	// name of a strategy in insertIdFuncs.
+	InsertId string `json:"insert_id,omitempty"`
+
+	// InsertIdLength is the length of random insertIds, overriding
+	// -insert-id-length.
+	InsertIdLength int `json:"insert_id_length,omitempty"`
+
+	// DenyFields are the top-level fields that must not reach the table.
+	// DenyPolicy is "strip" (default) to remove them from the row, or
+	// "reject" to fail the row.
+	DenyFields []string `json:"deny_fields,omitempty"`
+	DenyPolicy string   `json:"deny_policy,omitempty"`
+
+	// Rename maps top-level field names of the rows to the column names.
+	// It is applied before DenyFields, which names the columns.
+	Rename map[string]string `json:"rename,omitempty"`
+}
+
+var defaultTableConfig = &tableConfig{}
+
+func loadTableConfig(path string) (map[string]*tableConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	configs := make(map[string]*tableConfig)
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	for table, config := range configs {
+		if _, _, _, err := splitTablePath(table); err != nil {
+			return nil, err
+		} else if err := checkInsertIdStrategy(config.InsertId); err != nil {
+			return nil, fmt.Errorf("%s: %v", table, err)
+		} else if config.DenyPolicy != "" && config.DenyPolicy != "strip" && config.DenyPolicy != "reject" {
+			return nil, fmt.Errorf("%s: invalid deny_policy %s", table, config.DenyPolicy)
+		}
+		if config.InsertIdLength != 0 {
+			if err := checkInsertIdLength(config.InsertIdLength); err != nil {
+				return nil, fmt.Errorf("%s: %v", table, err)
+			}
+		}
+		for from, to := range config.Rename {
+			// 連鎖するとmapの順序で結果が変わる
+			if _, ok := config.Rename[to]; ok || to == "" {
+				return nil, fmt.Errorf("%s: invalid rename %s to %s", table, from, to)
+			}
+		}
+	}
+	return configs, nil
+}
+
+// idLength returns the length of random insertIds for the table.
+func (c *tableConfig) idLength() int {
+	if c.InsertIdLength > 0 {
+		return c.InsertIdLength
+	}
+	return Options.InsertIdLength
+}
+
+// tableConfigFor returns the configuration of the table, or the default.
+func tableConfigFor(table string) *tableConfig {
+	if config, ok := Options.TableConfigs[table]; ok {
+		return config
+	}
+	return defaultTableConfig
+}
+
+func checkInsertIdStrategy(strategy string) error {
+	if _, ok := insertIdFuncs[strategy]; ok || strategy == "" {
+		return nil
+	} else if strings.HasPrefix(strategy, "field:") && len(strategy) > len("field:") {
+		return nil
+	}
+	return fmt.Errorf("invalid insert_id strategy %s", strategy)
+}
+
+// applyRename renames the fields of the row. Unmapped fields are kept.
+func (c *tableConfig) applyRename(row map[string]interface{}) {
+	for from, to := range c.Rename {
+		if value, ok := row[from]; ok {
+			delete(row, from)
+			row[to] = value
+		}
+	}
+}
+
+// applyDenyFields removes the denied fields from the row, or returns an
+// error for the first one with the reject policy.
+func (c *tableConfig) applyDenyFields(row map[string]interface{}) error {
+	for _, field := range c.DenyFields {
+		if _, ok := row[field]; !ok {
+			continue
+		} else if c.DenyPolicy == "reject" {
+			return fmt.Errorf("field %s is not allowed", field)
+		}
+		delete(row, field)
+	}
+	return nil
+}
+
+// BigQueryのinsertIdは128文字まで
+const maxInsertIdLength = 128
+
+func checkInsertIdLength(length int) error {
+	if length <= 0 || length > maxInsertIdLength {
+		return fmt.Errorf("insert id length must be between 1 and %d", maxInsertIdLength)
+	}
+	return nil
+}
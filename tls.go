@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds the TLS configuration from -tls-min-version and
+// -tls-ciphers. Without -tls-ciphers the defaults of crypto/tls are used.
+// The cipher suites do not apply to TLS 1.3, which is not configurable.
+func newTLSConfig() (*tls.Config, error) {
+	version, ok := tlsVersions[Options.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid tls-min-version %s", Options.TLSMinVersion)
+	}
+	config := &tls.Config{MinVersion: version}
+	if Options.TLSCiphers == "" {
+		return config, nil
+	}
+
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	for _, name := range strings.Split(Options.TLSCiphers, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := suites[name]
+		if !ok {
+			// 安全でないスイートも名前で指定できない
+			return nil, fmt.Errorf("invalid tls cipher %s", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	// HTTP/2はTLS 1.2でAES-128-GCMのスイートを必須とし、
+	// なければServeTLSが起動時に失敗する
+	if version < tls.VersionTLS13 && !hasHTTP2CipherSuite(config.CipherSuites) {
+		return nil, fmt.Errorf("tls-ciphers must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 for HTTP/2")
+	}
+	return config, nil
+}
+
+func hasHTTP2CipherSuite(suites []uint16) bool {
+	for _, id := range suites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
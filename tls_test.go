@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestNewTLSConfigRequiresHTTP2CipherSuite(t *testing.T) {
+	defer func(version, ciphers string) {
+		Options.TLSMinVersion, Options.TLSCiphers = version, ciphers
+	}(Options.TLSMinVersion, Options.TLSCiphers)
+
+	Options.TLSMinVersion = "1.2"
+	Options.TLSCiphers = "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"
+	if _, err := newTLSConfig(); err == nil {
+		t.Error("newTLSConfig() accepted ciphers without AES-128-GCM")
+	}
+
+	Options.TLSCiphers = "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+	if _, err := newTLSConfig(); err != nil {
+		t.Errorf("newTLSConfig() = %v", err)
+	}
+
+	// TLS 1.3のスイートは設定に関係しない
+	Options.TLSMinVersion = "1.3"
+	Options.TLSCiphers = "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"
+	if _, err := newTLSConfig(); err != nil {
+		t.Errorf("newTLSConfig() = %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is nil unless -otel is set. Callers check it before building any
+// span so that tracing has no overhead when disabled.
+var tracer trace.Tracer
+
+var tracerProvider *sdktrace.TracerProvider
+
+// initTracing exports spans with OTLP. The exporter is configured by the
+// standard OTEL_EXPORTER_OTLP_* environment variables.
+func initTracing() error {
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return err
+	}
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tracerProvider)
+	tracer = tracerProvider.Tracer("bq-proxy")
+	return nil
+}
+
+// shutdownTracing flushes the spans not exported yet.
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		logger.Warnf("tracing: %v", err)
+	}
+}
+
+func startRequestSpan(ctx context.Context, project, dataset, table string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "insert", trace.WithAttributes(
+		attribute.String("bigquery.project", project),
+		attribute.String("bigquery.dataset", dataset),
+		attribute.String("bigquery.table", table),
+	))
+}
+
+func setResultAttributes(span trace.Span, result *response) {
+	span.SetAttributes(
+		attribute.Int("bigquery.rows", result.rows),
+		attribute.Int("bigquery.errors", result.errorCount()),
+	)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+// userAgentTransport adds the proxy User-Agent to outgoing requests.
+type userAgentTransport struct {
+	userAgent string
+	base      http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTripperはリクエストを変更してはいけないのでコピーする
+	r := req.Clone(req.Context())
+	if ua := req.Header.Get("User-Agent"); ua != "" {
+		r.Header.Set("User-Agent", t.userAgent+" "+ua)
+	} else {
+		r.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(r)
+}
+
+// newAPIClient returns the client of the BigQuery API calls made by the
+// proxy itself. The requests carry userAgent. http.DefaultTransport is not
+// changed, so the writer and the other clients keep their own User-Agent.
+func newAPIClient(userAgent string) *http.Client {
+	client := &http.Client{Timeout: time.Second * 30}
+	if userAgent != "" {
+		client.Transport = &userAgentTransport{
+			userAgent: userAgent,
+			base:      http.DefaultTransport,
+		}
+	}
+	return client
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewAPIClientSetsUserAgent(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+	}))
+	defer srv.Close()
+
+	base := http.DefaultTransport
+	resp, err := newAPIClient("bq-proxy/test").Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got != "bq-proxy/test" {
+		t.Errorf("User-Agent = %q, want bq-proxy/test", got)
+	}
+
+	// writerなど他のクライアントには影響しない
+	if http.DefaultTransport != base {
+		t.Errorf("http.DefaultTransport was replaced")
+	}
+}
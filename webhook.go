@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// webhookで送るエラーメッセージの最大数
+const webhookSampleSize = 5
+
+var webhookClient = &http.Client{Timeout: time.Second * 10}
+
+type webhookPayload struct {
+	Table   string   `json:"table"`
+	Rows    int      `json:"rows"`
+	Errors  int      `json:"errors"`
+	Samples []string `json:"samples"`
+}
+
+// errorWebhook posts a summary of batches with a high error ratio.
+// It is best-effort: at most one post per interval, and failures are
+// only logged.
+type errorWebhook struct {
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (e *errorWebhook) allow() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if time.Since(e.last) < Options.ErrorWebhookInterval {
+		return false
+	}
+	e.last = time.Now()
+	return true
+}
+
+func (e *errorWebhook) notify(table string, result *response) {
+	if Options.ErrorWebhook == "" || result.rows <= 0 || len(result.Errors) == 0 {
+		return
+	}
+	ratio := float64(len(result.Errors)) / float64(result.rows)
+	if ratio < Options.ErrorWebhookRatio || !e.allow() {
+		return
+	}
+
+	payload := &webhookPayload{
+		Table:   table,
+		Rows:    result.rows,
+		Errors:  len(result.Errors),
+		Samples: make([]string, 0, webhookSampleSize),
+	}
+	for _, we := range result.Errors {
+		if len(payload.Samples) >= webhookSampleSize {
+			break
+		}
+		payload.Samples = append(payload.Samples, we.Error.Error())
+	}
+
+	// クライアントへのレスポンスを遅らせないように非同期で送る
+	go func() {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			logger.Warnf("webhook: %v", err)
+			return
+		}
+		resp, err := webhookClient.Post(Options.ErrorWebhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logger.Warnf("webhook: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Warnf("webhook: %s", resp.Status)
+		}
+	}()
+}